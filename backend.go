@@ -0,0 +1,103 @@
+package env86
+
+import (
+	"context"
+
+	"github.com/chromedp/chromedp"
+	"tractor.dev/toolkit-go/desktop"
+	"tractor.dev/toolkit-go/desktop/app"
+	"tractor.dev/toolkit-go/desktop/window"
+)
+
+// Backend launches hosts for the emulator. A host is anything that can load
+// the console page at url and let it connect back to the VM over /ctl, such
+// as a desktop webview window or a headless browser.
+type Backend interface {
+	// Launch starts loading url and returns once the host is underway. The VM
+	// waits separately for the console to connect. If the host fails after
+	// Launch returns, it should call fail with the error.
+	Launch(url string, config Config, fail func(error)) (Host, error)
+}
+
+// Host is an emulator host started by a Backend
+type Host interface {
+	// Close unloads the console page and releases the host
+	Close() error
+}
+
+// WebviewBackend hosts the emulator in a desktop webview window. The window
+// is hidden when Config.NoConsole is set.
+type WebviewBackend struct {
+	app *app.App
+}
+
+func (b *WebviewBackend) Launch(url string, config Config, fail func(error)) (Host, error) {
+	if b.app == nil {
+		launched := make(chan bool)
+		b.app = app.Run(app.Options{
+			Accessory: true,
+			Agent:     true,
+		}, func() {
+			launched <- true
+		})
+		<-launched
+	}
+
+	h := &webviewHost{}
+	desktop.Dispatch(func() {
+		h.win = window.New(window.Options{
+			Center: true,
+			Hidden: config.NoConsole,
+			Size: window.Size{
+				Width:  1004,
+				Height: 785,
+			},
+			Resizable: true,
+			URL:       url,
+		})
+		h.win.Reload()
+	})
+	return h, nil
+}
+
+type webviewHost struct {
+	win *window.Window
+}
+
+func (h *webviewHost) Close() error {
+	desktop.Dispatch(func() {
+		if h.win != nil {
+			h.win.Unload()
+			h.win = nil
+		}
+	})
+	return nil
+}
+
+// ChromeDPBackend hosts the emulator in headless Chrome using chromedp.
+type ChromeDPBackend struct {
+	// Context is the parent for the browser context. Set it to a context
+	// from chromedp.NewRemoteAllocator to use an already running Chrome.
+	Context context.Context
+}
+
+func (b *ChromeDPBackend) Launch(url string, config Config, fail func(error)) (Host, error) {
+	parent := b.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := chromedp.NewContext(parent)
+	go func() {
+		if err := chromedp.Run(ctx, chromedp.Navigate(url)); err != nil && ctx.Err() == nil {
+			fail(err)
+		}
+	}()
+	return cdpHost(cancel), nil
+}
+
+type cdpHost context.CancelFunc
+
+func (h cdpHost) Close() error {
+	h()
+	return nil
+}
@@ -4,14 +4,10 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
-	"path/filepath"
-	"strings"
 
 	"github.com/progrium/env86"
 
-	"github.com/progrium/go-netstack/vnet"
 	"tractor.dev/toolkit-go/engine/cli"
 )
 
@@ -25,31 +21,23 @@ func bootCmd() *cli.Command {
 		enableNet   bool
 		coldBoot    bool
 		saveOnExit  bool
-		portForward string
+		forwards    stringSlice
 		consoleURL  bool
 		useCDP      bool
+		stateFormat string
+		memory      string
+		vgaMemory   string
+		netFlags    networkFlags
+		condFlags   conditionFlags
+		networkURL  string
+		pcapFile    string
 	)
 	cmd := &cli.Command{
 		Usage: "boot <image>",
 		Short: "boot and run a VM",
 		Args:  cli.MinArgs(1),
 		Run: func(ctx *cli.Context, args []string) {
-			imagePath := args[0]
-			var err error
-			if !strings.HasPrefix(imagePath, "./") && !strings.HasPrefix(imagePath, ".\\") {
-				exists, fullPath := globalImage(imagePath)
-				if !exists {
-					log.Fatal("global image not found")
-				}
-				imagePath = fullPath
-			} else {
-				imagePath, err = filepath.Abs(imagePath)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			image, err := env86.LoadImage(imagePath)
+			image, err := env86.LoadImage(imagePath(args[0]))
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -65,8 +53,24 @@ func bootCmd() *cli.Command {
 			cfg.NoConsole = noConsole
 			cfg.EnableTTY = enableTTY
 			cfg.ExitPattern = exitOn
-			cfg.EnableNetwork = enableNet
+			cfg.EnableNetwork = enableNet || networkURL != ""
+			netFlags.apply(&cfg.Network)
+			cfg.CaptureFile = pcapFile
+			cfg.NetworkConditions = condFlags.conditions()
+			if networkURL != "" {
+				cfg.NetworkRelayURL = networkURL
+			} else if enableNet {
+				cfg.Network, err = cfg.Network.Resolve()
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
 			cfg.ChromeDP = useCDP
+			memorySize, vgaMemorySize := applyMemoryFlags(&cfg, memory, vgaMemory)
+			cfg.StateFormat, err = env86.ParseStateFormat(stateFormat)
+			if err != nil {
+				log.Fatal(err)
+			}
 
 			cfg.ConsoleAddr = env86.ListenAddr()
 
@@ -74,46 +78,41 @@ func bootCmd() *cli.Command {
 			if err != nil {
 				log.Fatal(err)
 			}
-			vm.Start()
+			saveMemorySizes(image, cfg, memorySize, vgaMemorySize)
+			if err := vm.Start(); err != nil {
+				log.Fatal(err)
+			}
 
 			if consoleURL {
 				fmt.Printf("Console URL: http://%s/console.html\n", env86.LocalhostAddr(cfg.ConsoleAddr))
 			}
 
 			if !cfg.EnableTTY {
-				go func() {
-					buffer := make([]byte, 1024)
-					for {
-						_, err := os.Stdin.Read(buffer)
-						if err == io.EOF {
-							vm.Exit("Ctrl-D detected")
-							return
-						}
-					}
-				}()
+				go exitOnEOF(vm)
 			}
 
-			if enableNet {
-				// todo: not sure how to decide when to do this since most of the
-				// time we don't really want to ...
-				if cfg.PreserveMAC {
-					// this adds the vm nic to the switch route table
-					// so we can immediately dial the vm nic in port forwarding
-					vm.Console().SendKeyboard("ping -c 1 192.168.127.1\n")
-				}
+			if cfg.EnableNetwork {
+				announceGuest(vm, cfg)
+			}
 
-				if portForward != "" {
-					go forwardPort(vm.Network(), portForward)
+			for _, spec := range forwards {
+				if err := vm.Forward(spec); err != nil {
+					log.Fatal(err)
 				}
 			}
 
-			vm.Wait()
+			if _, err := vm.Wait(); err != nil {
+				log.Fatal(err)
+			}
 		},
 	}
 	cmd.Flags().BoolVar(&useCDP, "cdp", false, "use headless chrome")
 	cmd.Flags().BoolVar(&consoleURL, "console-url", false, "show the URL to the console")
 	cmd.Flags().BoolVar(&saveOnExit, "save", false, "save initial state to image on exit")
+	cmd.Flags().StringVar(&stateFormat, "state-format", "", "format to save state in: raw or zstd (default zstd)")
 	cmd.Flags().BoolVar(&coldBoot, "cold", false, "cold boot without initial state")
+	cmd.Flags().StringVar(&memory, "memory", "", "memory size, saved to image (ex: 1G, 256M)")
+	cmd.Flags().StringVar(&vgaMemory, "vga-memory", "", "VGA memory size, saved to image (ex: 16M)")
 	cmd.Flags().BoolVar(&enableNet, "net", false, "enable networking")
 	cmd.Flags().BoolVar(&enableNet, "n", false, "enable networking (shorthand)")
 	cmd.Flags().BoolVar(&noConsole, "no-console", false, "disable console window")
@@ -121,42 +120,46 @@ func bootCmd() *cli.Command {
 	cmd.Flags().BoolVar(&noMouse, "no-mouse", false, "disable mouse")
 	cmd.Flags().BoolVar(&noKeyboard, "no-keyboard", false, "disable keyboard")
 	cmd.Flags().StringVar(&exitOn, "exit-on", "", "exit when string is matched in serial TTY")
-	cmd.Flags().StringVar(&portForward, "p", "", "forward TCP port (ex: 8080:80)")
+	cmd.Flags().Var(&forwards, "p", "forward a port, can be repeated (ex: 8080:80, 127.0.0.1:5353:53/udp)")
+	cmd.Flags().StringVar(&networkURL, "network-url", "", "join the network of a relay, such as from env86 network (ex: ws://localhost:8086)")
+	cmd.Flags().StringVar(&pcapFile, "pcap", "", "capture network traffic to a pcap file, or pcapng if it ends in .pcapng")
+	netFlags.register(cmd.Flags())
+	condFlags.register(cmd.Flags())
 	return cmd
 }
 
-func forwardPort(vn *vnet.VirtualNetwork, spec string) error {
-	parts := strings.Split(spec, ":")
-	l, err := net.Listen("tcp", ":"+parts[0])
-	if err != nil {
-		return err
-	}
-	defer l.Close()
-	targetAddr := "192.168.127.2:" + parts[1]
-	handle := func(conn net.Conn) {
-		defer conn.Close()
-		backend, err := vn.Dial("tcp", targetAddr)
-		if err != nil {
-			log.Printf("Failed to connect to target server: %v", err)
-			return
+// announceGuest makes the guest send traffic, which adds the vm nic to the
+// switch route table so port forwarding can dial it right away
+func announceGuest(vm *env86.VM, cfg env86.Config) {
+	guest := vm.Guest()
+	switch {
+	case guest != nil && guest.Protocol() >= 2:
+		// the guest configures itself, so this only announces it
+		if err := guest.ConfigureNetwork(env86.GuestNetworkOptions{}); err != nil {
+			log.Println("guest:", err)
+		}
+	case !cfg.PreserveMAC:
+		// only a NIC restored with its MAC from the state needs announcing
+	case guest != nil:
+		// older guest services can only rerun the network setup, which
+		// sends traffic as it gets a lease
+		if err := guest.ResetNetwork(); err != nil {
+			log.Println("guest:", err)
 		}
-		defer backend.Close()
-		done := make(chan struct{})
-		go func() {
-			io.Copy(backend, conn)
-			done <- struct{}{}
-		}()
-		go func() {
-			io.Copy(conn, backend)
-			done <- struct{}{}
-		}()
-		<-done
+	case cfg.Network.GatewayIP != "" && !cfg.DisableKeyboard:
+		// without a guest service, ping the gateway from the console
+		vm.Console().SendKeyboard("ping -c 1 " + cfg.Network.GatewayIP + "\n")
 	}
+}
+
+// exitOnEOF exits the VM when stdin is closed, such as with Ctrl-D
+func exitOnEOF(vm *env86.VM) {
+	buffer := make([]byte, 1024)
 	for {
-		conn, err := l.Accept()
-		if err != nil {
-			continue
+		_, err := os.Stdin.Read(buffer)
+		if err == io.EOF {
+			vm.Exit(env86.ExitCtrlD)
+			return
 		}
-		go handle(conn)
 	}
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+
+	"github.com/progrium/env86"
+
+	"tractor.dev/toolkit-go/engine/cli"
+)
+
+func convertCmd() *cli.Command {
+	cmd := &cli.Command{
+		Usage: "convert <image> raw|zstd",
+		Short: "convert saved states of an image to raw or zstd compressed",
+		Args:  cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			format, err := env86.ParseStateFormat(args[1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := image.ConvertState(format); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/progrium/env86"
+	"github.com/progrium/env86/tarutil"
+	"golang.org/x/term"
+
+	"tractor.dev/toolkit-go/engine/cli"
+)
+
+func cpCmd() *cli.Command {
+	var (
+		vmAddr string
+		image  string
+		save   bool
+		quiet  bool
+	)
+	cmd := &cli.Command{
+		Usage: "cp <src> <dst>",
+		Short: "copy files between the host and a VM (requires guest service)",
+		Long: `Copies a file or directory recursively between the host and a VM. The path
+in the VM is absolute and starts with vm:, like vm:/root/out. If the destination
+is an existing directory, the source is copied into it, otherwise it's copied
+to the destination. Permissions, symbolic links and mtimes are kept.
+
+With -vm, files are copied with a VM that's already running, given by the
+address of its console server as shown by env86 boot -console-url. With -image,
+the image is booted for the copy and stopped afterwards. Use -save to save its
+state after copying so files copied into it are kept.`,
+		Args: cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			src, srcInVM := strings.CutPrefix(args[0], "vm:")
+			dst, dstInVM := strings.CutPrefix(args[1], "vm:")
+			if srcInVM == dstInVM {
+				log.Fatal("one of the paths must be in the VM, like vm:/root")
+			}
+			guestPath := dst
+			if srcInVM {
+				guestPath = src
+			}
+			if !path.IsAbs(guestPath) {
+				log.Fatalf("path in the VM must be absolute: %s", guestPath)
+			}
+
+			var vm *env86.VM
+			var guest *env86.Guest
+			var err error
+			switch {
+			case vmAddr != "" && image != "":
+				log.Fatal("-vm and -image can't be used together")
+			case vmAddr != "":
+				if save {
+					log.Fatal("-save can only be used with -image")
+				}
+				guest, err = env86.DialGuest(consoleAddr(vmAddr))
+				if err != nil {
+					log.Fatal(err)
+				}
+			case image != "":
+				vm = bootForCopy(image)
+				guest = vm.Guest()
+			default:
+				log.Fatal("either -vm or -image is needed to copy with a VM")
+			}
+
+			if srcInVM {
+				err = copyFromGuest(guest, src, dst, quiet)
+			} else {
+				err = copyToGuest(guest, src, dst, quiet)
+			}
+			if vm != nil {
+				if err == nil && save {
+					err = vm.SaveInitialState()
+				}
+				vm.Stop()
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&vmAddr, "vm", "", "console address of a running VM (ex: localhost:40123)")
+	cmd.Flags().StringVar(&image, "image", "", "image to boot for the copy")
+	cmd.Flags().BoolVar(&save, "save", false, "save initial state to image after copying")
+	cmd.Flags().BoolVar(&quiet, "q", false, "don't show progress")
+	return cmd
+}
+
+// consoleAddr returns the address of a console server from either an
+// address or a console URL
+func consoleAddr(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return s
+}
+
+// bootForCopy boots an image without a console and waits for its guest
+// service
+func bootForCopy(arg string) *env86.VM {
+	image, err := env86.LoadImage(imagePath(arg))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := image.Config()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.ConsoleAddr = env86.ListenAddr()
+	cfg.NoConsole = true
+
+	vm, err := env86.New(image, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := vm.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if vm.Guest() == nil {
+		vm.Stop()
+		log.Fatal("guest not found")
+	}
+	if err := vm.Guest().SyncClock(); err != nil {
+		vm.Stop()
+		log.Fatal(err)
+	}
+	return vm
+}
+
+// copyToGuest copies a file or directory on the host to dst in the guest
+func copyToGuest(guest *env86.Guest, src, dst string, quiet bool) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	size, err := treeSize(src)
+	if err != nil {
+		return err
+	}
+
+	dst = path.Clean(dst)
+	dir, name := path.Dir(dst), path.Base(dst)
+	fsName := strings.TrimPrefix(dst, "/")
+	if fsName == "" {
+		fsName = "."
+	}
+	fi, err := guest.FS().Stat(fsName)
+	switch {
+	case err == nil && fi.IsDir():
+		dir, name = dst, ""
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	p := newProgress(size, quiet)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarutil.Write(pw, src, p))
+	}()
+	err = guest.Extract(pr, dir, name)
+	pr.CloseWithError(errors.New("copy stopped"))
+	p.finish(err == nil)
+	return err
+}
+
+// copyFromGuest copies a file or directory in the guest to dst on the host
+func copyFromGuest(guest *env86.Guest, src, dst string, quiet bool) error {
+	r, size, err := guest.Archive(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dst = filepath.Clean(dst)
+	dir, name := filepath.Dir(dst), filepath.Base(dst)
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dir, name = dst, ""
+	}
+
+	p := newProgress(size, quiet)
+	err = tarutil.Extract(r, dir, name, p)
+	p.finish(err == nil)
+	return err
+}
+
+// treeSize is the total size of the regular files under root
+func treeSize(root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// progressMin is the smallest copy that shows progress
+const progressMin = 1024 * 1024
+
+// progress shows how much of a copy is done on stderr, if it's a terminal
+// and the copy is large enough to be worth it. Writes count as progress.
+type progress struct {
+	total int64
+	done  int64
+	shown time.Time
+	show  bool
+}
+
+func newProgress(total int64, quiet bool) *progress {
+	return &progress{
+		total: total,
+		show:  !quiet && total >= progressMin && term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.show && time.Since(p.shown) >= 100*time.Millisecond {
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progress) print() {
+	percent := p.done * 100 / p.total
+	fmt.Fprintf(os.Stderr, "\r%s / %s (%d%%)", formatBytes(p.done), formatBytes(p.total), min(percent, 100))
+	p.shown = time.Now()
+}
+
+// finish shows the final progress and ends the line
+func (p *progress) finish(ok bool) {
+	if !p.show {
+		return
+	}
+	if ok {
+		p.print()
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
@@ -17,9 +17,11 @@ import (
 
 func createCmd() *cli.Command {
 	var (
-		dir    string
-		docker string
-		guest  bool
+		dir       string
+		docker    string
+		guest     bool
+		memory    string
+		vgaMemory string
 	)
 	cmd := &cli.Command{
 		Usage: "create <image>",
@@ -93,6 +95,8 @@ func createCmd() *cli.Command {
 				log.Fatal("nothing to create from")
 			}
 
+			memorySize, vgaMemorySize := parseMemoryFlags(memory, vgaMemory)
+
 			if guest {
 				if err := fsutil.CopyFS(assets.Dir, "guest86", osfs.New(), path.Join(dir, "bin/guest86")); err != nil {
 					log.Fatal(err)
@@ -113,6 +117,12 @@ func createCmd() *cli.Command {
 			if guest {
 				imageConfig["has_guest_service"] = true
 			}
+			if memorySize != 0 {
+				imageConfig["memory_size"] = memorySize
+			}
+			if vgaMemorySize != 0 {
+				imageConfig["vga_memory_size"] = vgaMemorySize
+			}
 
 			// look for bootable kernel
 			var kernelMatches []string
@@ -152,6 +162,8 @@ func createCmd() *cli.Command {
 	cmd.Flags().StringVar(&dir, "from-dir", "", "make image from directory root")
 	cmd.Flags().StringVar(&docker, "from-docker", "", "make image from Docker image or Dockerfile")
 	cmd.Flags().BoolVar(&guest, "with-guest", false, "add guest service to /bin")
+	cmd.Flags().StringVar(&memory, "memory", "", "memory size (ex: 1G, 256M, default 512M)")
+	cmd.Flags().StringVar(&vgaMemory, "vga-memory", "", "VGA memory size (ex: 16M, default 8M)")
 	return cmd
 }
 
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/progrium/env86"
+
+	"tractor.dev/toolkit-go/engine/cli"
+)
+
+func inspectCmd() *cli.Command {
+	var asJSON bool
+	cmd := &cli.Command{
+		Usage: "inspect <image>",
+		Short: "show the configuration and contents of an image",
+		Args:  cli.MinArgs(1),
+		Run: func(ctx *cli.Context, args []string) {
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			report, err := image.Inspect()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(report); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			conf := report.Config
+			fmt.Fprintln(w, "Config:")
+			fmt.Fprintf(w, "  Memory:\t%s\n", orDefault(conf.MemorySize, env86.DefaultMemorySize))
+			fmt.Fprintf(w, "  VGA memory:\t%s\n", orDefault(conf.VGAMemorySize, env86.DefaultVGAMemorySize))
+			fmt.Fprintf(w, "  Cmdline:\t%s\n", conf.Cmdline)
+			fmt.Fprintf(w, "  Kernel from filesystem:\t%v\n", conf.BZImageInitrdFromFilesystem)
+			for _, disk := range []struct {
+				name string
+				conf *env86.ImageConfig
+			}{
+				{"BIOS", conf.BIOS},
+				{"VGA BIOS", conf.VGABIOS},
+				{"bzImage", conf.BZImage},
+				{"Initrd", conf.Initrd},
+				{"HDA", conf.HDA},
+				{"FDA", conf.FDA},
+				{"CD-ROM", conf.CDROM},
+			} {
+				if disk.conf != nil {
+					fmt.Fprintf(w, "  %s:\t%s\n", disk.name, disk.conf.URL)
+				}
+			}
+
+			fmt.Fprintln(w, "Initial state:")
+			if s := report.InitialState; s != nil {
+				fmt.Fprintf(w, "  File:\t%s\n", s.File)
+				fmt.Fprintf(w, "  Format:\t%s\n", s.Format)
+				fmt.Fprintf(w, "  Size:\t%d\n", s.Size)
+				if s.UncompressedSize > 0 {
+					fmt.Fprintf(w, "  Uncompressed size:\t%d\n", s.UncompressedSize)
+				}
+				if s.MemorySize > 0 {
+					fmt.Fprintf(w, "  Memory:\t%s\n", env86.FormatSize(s.MemorySize))
+				}
+			} else {
+				fmt.Fprintln(w, "  none")
+			}
+			if len(report.Snapshots) > 0 {
+				fmt.Fprintf(w, "Snapshots:\t%s\n", strings.Join(report.Snapshots, ", "))
+			}
+
+			fmt.Fprintln(w, "Filesystem:")
+			if f := report.Filesystem; f != nil {
+				fmt.Fprintf(w, "  Files:\t%d\n", f.Files)
+				fmt.Fprintf(w, "  Directories:\t%d\n", f.Dirs)
+				fmt.Fprintf(w, "  Symlinks:\t%d\n", f.Symlinks)
+				fmt.Fprintf(w, "  Total size:\t%d\n", f.TotalSize)
+				fmt.Fprintf(w, "  Blobs:\t%d\n", f.Blobs)
+				fmt.Fprintf(w, "  Kernel:\t%s\n", orNone(report.Kernel))
+				fmt.Fprintf(w, "  Initrd:\t%s\n", orNone(report.Initrd))
+			} else {
+				fmt.Fprintln(w, "  none")
+			}
+
+			fmt.Fprintln(w, "Guest service:")
+			fmt.Fprintf(w, "  has_guest_service:\t%v\n", report.GuestService.Enabled)
+			fmt.Fprintf(w, "  bin/guest86 present:\t%v\n", report.GuestService.Present)
+
+			if len(report.Problems) > 0 {
+				fmt.Fprintln(w, "Problems:")
+				for _, p := range report.Problems {
+					fmt.Fprintf(w, "  - %s\n", p)
+				}
+			}
+			w.Flush()
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "output report as JSON")
+	return cmd
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+func orDefault(size, def int) string {
+	if size == 0 {
+		return env86.FormatSize(def) + " (default)"
+	}
+	return env86.FormatSize(size)
+}
@@ -9,6 +9,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/progrium/env86"
 	"github.com/progrium/env86/fsutil"
 
 	"tractor.dev/toolkit-go/desktop"
@@ -34,7 +35,12 @@ func main() {
 	root.AddCommand(createCmd())
 	root.AddCommand(assetsCmd())
 	root.AddCommand(runCmd())
+	root.AddCommand(cpCmd())
 	root.AddCommand(pullCmd())
+	root.AddCommand(snapshotCmd())
+	root.AddCommand(convertCmd())
+	root.AddCommand(packCmd())
+	root.AddCommand(inspectCmd())
 
 	desktop.Start(func() {
 		if err := cli.Execute(context.Background(), root, os.Args[1:]); err != nil {
@@ -57,6 +63,69 @@ func env86Path() string {
 	return path
 }
 
+// imagePath resolves an image argument to a path, treating arguments
+// starting with ./ as local paths and anything else as a global image
+func imagePath(arg string) string {
+	if !strings.HasPrefix(arg, "./") && !strings.HasPrefix(arg, ".\\") {
+		exists, fullPath := globalImage(arg)
+		if !exists {
+			log.Fatal("global image not found")
+		}
+		return fullPath
+	}
+	path, err := filepath.Abs(arg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return path
+}
+
+// parseMemoryFlags parses the values of the --memory and --vga-memory
+// flags, returning zero for flags that weren't given
+func parseMemoryFlags(memory, vgaMemory string) (int, int) {
+	var sizes [2]int
+	for i, s := range []string{memory, vgaMemory} {
+		if s == "" {
+			continue
+		}
+		n, err := env86.ParseSize(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sizes[i] = n
+	}
+	return sizes[0], sizes[1]
+}
+
+// applyMemoryFlags sets the sizes from the --memory and --vga-memory flags
+// in cfg and returns them, with zero for flags that weren't given
+func applyMemoryFlags(cfg *env86.Config, memory, vgaMemory string) (int, int) {
+	memorySize, vgaMemorySize := parseMemoryFlags(memory, vgaMemory)
+	if memorySize != 0 {
+		cfg.MemorySize = memorySize
+	}
+	if vgaMemorySize != 0 {
+		cfg.VGAMemorySize = vgaMemorySize
+	}
+	return memorySize, vgaMemorySize
+}
+
+// saveMemorySizes keeps the sizes from applyMemoryFlags in the image once
+// the VM is made with them. A state only restores with the sizes it was
+// saved with, so they're only kept if the image has no state or a cold
+// boot will save over it.
+func saveMemorySizes(image *env86.Image, cfg env86.Config, memorySize, vgaMemorySize int) {
+	if memorySize == 0 && vgaMemorySize == 0 {
+		return
+	}
+	if image.HasInitialState() && !(cfg.ColdBoot && cfg.SaveOnExit) {
+		return
+	}
+	if err := image.SetMemorySize(memorySize, vgaMemorySize); err != nil {
+		log.Fatal(err)
+	}
+}
+
 // globalImage resolves a pathspec to a global image path
 // On Unix-like systems:
 // github.com/progrium/alpine@latest => ~/.env86/github.com/progrium/alpine/3.18
@@ -1,43 +1,261 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/progrium/env86"
 	"github.com/progrium/env86/network"
 
-	"github.com/progrium/go-netstack/vnet"
 	"tractor.dev/toolkit-go/engine/cli"
 )
 
 func networkCmd() *cli.Command {
+	var (
+		netFlags  networkFlags
+		condFlags conditionFlags
+		pcapFile  string
+		listen    string
+		token     string
+		noAuth    bool
+		origins   stringSlice
+		tlsCert   string
+		tlsKey    string
+		maxConns  int
+		rateLimit string
+	)
 	cmd := &cli.Command{
 		Usage: "network",
 		Short: "run virtual network and relay",
 		// Args:  cli.MinArgs(1),
 		Run: func(ctx *cli.Context, args []string) {
-			vn, err := vnet.New(&vnet.Configuration{
-				Debug:             false,
-				MTU:               1500,
-				Subnet:            "192.168.127.0/24",
-				GatewayIP:         "192.168.127.1",
-				GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-				GatewayVirtualIPs: []string{"192.168.127.253"},
-			})
+			var netcfg env86.NetworkConfig
+			netFlags.apply(&netcfg)
+			vn, err := env86.NewNetwork(netcfg)
 			if err != nil {
 				log.Fatal(err)
 			}
+			var opts network.Options
+			opts.Policy, err = netcfg.Policy()
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.Records, err = netcfg.Records()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if pcapFile != "" {
+				capture, err := network.CreateCapture(pcapFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer capture.Close()
+				opts.Taps = append(opts.Taps, capture.Tap)
+			}
+
+			opts.Conditions = condFlags.conditions()
+			opts.Origins = origins
+			opts.MaxConns = maxConns
+			opts.Services = true
+			if rateLimit != "" {
+				opts.RateLimit, err = env86.ParseSize(rateLimit)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			if !noAuth {
+				opts.Token = token
+				if opts.Token == "" {
+					opts.Token = randomToken()
+				}
+			}
+			if (tlsCert == "") != (tlsKey == "") {
+				log.Fatal("--tls-cert and --tls-key must be used together")
+			}
+
+			addr := listen
+			if addr == "" {
+				addr = env86.ListenAddr()
+			}
+			u := url.URL{Scheme: "ws", Host: env86.LocalhostAddr(addr)}
+			if strings.HasPrefix(u.Host, ":") {
+				u.Host = "localhost" + u.Host
+			}
+			if tlsCert != "" {
+				u.Scheme = "wss"
+			}
+			if opts.Token != "" {
+				u.RawQuery = url.Values{"token": {opts.Token}}.Encode()
+			}
+			fmt.Printf("Network URL: %s\n", u.String())
 
-			addr := env86.ListenAddr()
-			hostname := strings.ReplaceAll(addr, "0.0.0.0", "localhost")
-			fmt.Printf("Network URL: ws://%s\n", hostname)
-			if err := http.ListenAndServe(addr, network.Handler(vn)); err != nil {
+			srv := &http.Server{
+				Addr:    addr,
+				Handler: network.Handler(vn, opts),
+			}
+			if tlsCert != "" {
+				err = srv.ListenAndServeTLS(tlsCert, tlsKey)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
+	cmd.Flags().StringVar(&pcapFile, "pcap", "", "capture network traffic to a pcap file, or pcapng if it ends in .pcapng")
+	cmd.Flags().StringVar(&listen, "listen", "", "address to listen on (default random port on all interfaces)")
+	cmd.Flags().StringVar(&token, "token", "", "token clients must give to connect (default random)")
+	cmd.Flags().BoolVar(&noAuth, "no-auth", false, "allow clients to connect without a token")
+	cmd.Flags().Var(&origins, "origin", "origin browsers may connect from, can be repeated (default any)")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file to serve wss:// with")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS key file to serve wss:// with")
+	cmd.Flags().IntVar(&maxConns, "max-conns", 0, "maximum number of NICs connected at once (default unlimited)")
+	cmd.Flags().StringVar(&rateLimit, "rate-limit", "", "maximum bytes per second each NIC can send (ex: 1M)")
+	netFlags.register(cmd.Flags())
+	condFlags.register(cmd.Flags())
 	return cmd
 }
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// networkFlags set the topology of the virtual network. Flags that aren't
+// given keep the value from the image.
+type networkFlags struct {
+	subnet    string
+	gateway   string
+	guestIP   string
+	guestMAC  string
+	dnsSearch string
+	mtu       int
+	allow     stringSlice
+	deny      stringSlice
+	hosts     stringSlice
+	hostAlias bool
+}
+
+func (f *networkFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.subnet, "subnet", "", "virtual network subnet (default 192.168.127.0/24)")
+	flags.StringVar(&f.gateway, "gateway", "", "gateway, DNS and DHCP server IP (default first IP in subnet)")
+	flags.StringVar(&f.guestIP, "guest-ip", "", "IP the guest is expected to have (default first IP assigned by DHCP)")
+	flags.StringVar(&f.guestMAC, "guest-mac", "", "MAC address to always assign the guest IP to over DHCP")
+	flags.StringVar(&f.dnsSearch, "dns-search", "", "comma separated DNS search domains sent over DHCP")
+	flags.IntVar(&f.mtu, "mtu", 0, "MTU of the virtual network (default 1500)")
+	flags.Var(&f.allow, "allow", "only allow guest traffic out to a destination, can be repeated (ex: 10.0.0.0/8, mirror.internal:443/tcp)")
+	flags.Var(&f.hosts, "add-host", "add a DNS record for guests, can be repeated (ex: mirror.test:10.0.0.5, api.test:example.com)")
+	flags.Var(&f.deny, "deny", "deny guest traffic out to a destination, can be repeated (ex: *:25/tcp, *.example.com)")
+	flags.BoolVar(&f.hostAlias, "host-alias", false, "let guests reach the host loopback at "+env86.HostAlias)
+}
+
+func (f *networkFlags) apply(cfg *env86.NetworkConfig) {
+	if f.subnet != "" && f.subnet != cfg.Subnet {
+		hostIP := cfg.HostIP
+		// addresses from the image may not be in the new subnet
+		*cfg = env86.NetworkConfig{
+			Subnet:           f.subnet,
+			GatewayMAC:       cfg.GatewayMAC,
+			MTU:              cfg.MTU,
+			DNSSearchDomains: cfg.DNSSearchDomains,
+			GuestMAC:         cfg.GuestMAC,
+			Allow:            cfg.Allow,
+			Deny:             cfg.Deny,
+			DNS:              cfg.DNS,
+		}
+		if hostIP == env86.AutoHostIP {
+			cfg.HostIP = hostIP
+		}
+	}
+	if f.gateway != "" {
+		cfg.GatewayIP = f.gateway
+	}
+	if f.guestIP != "" {
+		cfg.GuestIP = f.guestIP
+	}
+	if f.guestMAC != "" {
+		cfg.GuestMAC = f.guestMAC
+	}
+	if f.dnsSearch != "" {
+		cfg.DNSSearchDomains = strings.Split(f.dnsSearch, ",")
+	}
+	if f.mtu != 0 {
+		cfg.MTU = f.mtu
+	}
+	if f.hostAlias && cfg.HostIP == "" {
+		cfg.HostIP = env86.AutoHostIP
+	}
+	// firewall rules add to the ones from the image
+	cfg.Allow = append(cfg.Allow, f.allow...)
+	cfg.Deny = append(cfg.Deny, f.deny...)
+	for _, host := range f.hosts {
+		record, err := env86.ParseDNSRecord(host)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.DNS = append(cfg.DNS, record)
+	}
+}
+
+// conditionFlags emulate a bad network between NICs and the switch
+type conditionFlags struct {
+	latency   time.Duration
+	jitter    time.Duration
+	bandwidth string
+	loss      string
+	reorder   string
+	seed      int64
+}
+
+func (f *conditionFlags) register(flags *flag.FlagSet) {
+	flags.DurationVar(&f.latency, "net-latency", 0, "delay network frames in each direction (ex: 100ms)")
+	flags.DurationVar(&f.jitter, "net-jitter", 0, "vary the delay of network frames by up to this much (ex: 20ms)")
+	flags.StringVar(&f.bandwidth, "net-bandwidth", "", "bytes per second the network carries in each direction (ex: 128K)")
+	flags.StringVar(&f.loss, "net-loss", "", "fraction of network frames to drop (ex: 1%)")
+	flags.StringVar(&f.reorder, "net-reorder", "", "fraction of network frames to deliver late, out of order (ex: 5%)")
+	flags.Int64Var(&f.seed, "net-seed", 0, "seed for random network conditions, to reproduce them (default random)")
+}
+
+// conditions returns the network conditions of the flags, which is nil
+// if none are given
+func (f *conditionFlags) conditions() *network.Conditions {
+	c := network.Conditions{
+		Latency: f.latency,
+		Jitter:  f.jitter,
+		Seed:    f.seed,
+	}
+	var err error
+	if f.bandwidth != "" {
+		if c.Bandwidth, err = env86.ParseSize(f.bandwidth); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if f.loss != "" {
+		if c.Loss, err = network.ParseRatio(f.loss); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if f.reorder != "" {
+		if c.Reorder, err = network.ParseRatio(f.reorder); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if c == (network.Conditions{Seed: f.seed}) {
+		return nil
+	}
+	return &c
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/progrium/env86"
+
+	"tractor.dev/toolkit-go/engine/cli"
+)
+
+func packCmd() *cli.Command {
+	var checksum bool
+	cmd := &cli.Command{
+		Usage: "pack <image> <out.tgz>",
+		Short: "write an image to a tarball for distribution",
+		Long: `Writes an image as a gzipped tarball that can be booted directly or
+published as a release asset named <image>-<tag>.tgz for pull. The same image
+always produces the same tarball. With -sha256, a checksum file in the format
+of sha256sum is written next to the tarball as <out.tgz>.sha256.`,
+		Args: cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			if err := pack(imagePath(args[0]), args[1], checksum); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&checksum, "sha256", false, "write a sha256 checksum file alongside")
+	return cmd
+}
+
+func pack(imageDir, out string, checksum bool) error {
+	outPath, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	// the tarball would end up packed into itself on a later pack
+	if rel, err := filepath.Rel(imageDir, outPath); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is inside the image directory", out)
+	}
+
+	image, err := env86.LoadImage(imageDir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(outPath), "."+filepath.Base(outPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	if err := image.WriteArchive(io.MultiWriter(f, h)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), outPath); err != nil {
+		return err
+	}
+
+	if checksum {
+		sum := fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), filepath.Base(outPath))
+		return os.WriteFile(outPath+".sha256", []byte(sum), 0644)
+	}
+	return nil
+}
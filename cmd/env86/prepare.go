@@ -4,7 +4,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/progrium/env86"
 	"github.com/progrium/env86/assets"
@@ -21,22 +20,7 @@ func prepareCmd() *cli.Command {
 		Short: "prepare a VM for publishing on the web",
 		Args:  cli.MinArgs(2),
 		Run: func(ctx *cli.Context, args []string) {
-			imagePath := args[0]
-			var err error
-			if !strings.HasPrefix(imagePath, "./") && !strings.HasPrefix(imagePath, ".\\") {
-				exists, fullPath := globalImage(imagePath)
-				if !exists {
-					log.Fatal("global image not found")
-				}
-				imagePath = fullPath
-			} else {
-				imagePath, err = filepath.Abs(imagePath)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			image, err := env86.LoadImage(imagePath)
+			image, err := env86.LoadImage(imagePath(args[0]))
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/progrium/env86"
 	"golang.org/x/term"
@@ -13,10 +15,16 @@ import (
 
 func runCmd() *cli.Command {
 	var (
-		enableNet   bool
-		portForward string
-		useCDP      bool
-		mountSpec   string
+		enableNet  bool
+		forwards   stringSlice
+		useCDP     bool
+		mountSpec  string
+		memory     string
+		vgaMemory  string
+		netFlags   networkFlags
+		condFlags  conditionFlags
+		networkURL string
+		pcapFile   string
 	)
 	cmd := &cli.Command{
 		Usage: "run <image> <cmd> [<args>...]",
@@ -32,8 +40,20 @@ func runCmd() *cli.Command {
 			if err != nil {
 				log.Fatal(err)
 			}
-			cfg.EnableNetwork = enableNet
+			cfg.EnableNetwork = enableNet || networkURL != ""
+			netFlags.apply(&cfg.Network)
+			cfg.CaptureFile = pcapFile
+			cfg.NetworkConditions = condFlags.conditions()
+			if networkURL != "" {
+				cfg.NetworkRelayURL = networkURL
+			} else if enableNet {
+				cfg.Network, err = cfg.Network.Resolve()
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
 			cfg.ChromeDP = useCDP
+			memorySize, vgaMemorySize := applyMemoryFlags(&cfg, memory, vgaMemory)
 			cfg.ConsoleAddr = env86.ListenAddr()
 			cfg.NoConsole = true
 
@@ -41,14 +61,30 @@ func runCmd() *cli.Command {
 			if err != nil {
 				log.Fatal(err)
 			}
-			vm.Start()
+			saveMemorySizes(image, cfg, memorySize, vgaMemorySize)
+			if err := vm.Start(); err != nil {
+				log.Fatal(err)
+			}
 
 			if vm.Guest() == nil {
 				log.Fatal("guest not found")
 			}
 
-			if err := vm.Guest().ResetNetwork(); err != nil {
-				log.Fatal(err)
+			if vm.Guest().Protocol() < 2 {
+				// older guest services can only rerun the network setup of
+				// Alpine, which also sets the clock
+				if err := vm.Guest().ResetNetwork(); err != nil {
+					log.Fatal(err)
+				}
+			} else {
+				if err := vm.Guest().SyncClock(); err != nil {
+					log.Fatal(err)
+				}
+				if cfg.EnableNetwork {
+					if err := vm.Guest().ConfigureNetwork(cfg.Network.GuestOptions()); err != nil {
+						log.Fatal(err)
+					}
+				}
 			}
 
 			if mountSpec != "" {
@@ -60,17 +96,9 @@ func runCmd() *cli.Command {
 				}()
 			}
 
-			if enableNet {
-				// todo: not sure how to decide when to do this since most of the
-				// time we don't really want to ...
-				if cfg.PreserveMAC {
-					// this adds the vm nic to the switch route table
-					// so we can immediately dial the vm nic in port forwarding
-					vm.Console().SendKeyboard("ping -c 1 192.168.127.1\n")
-				}
-
-				if portForward != "" {
-					go forwardPort(vm.Network(), portForward)
+			for _, spec := range forwards {
+				if err := vm.Forward(spec); err != nil {
+					log.Fatal(err)
 				}
 			}
 
@@ -78,12 +106,50 @@ func runCmd() *cli.Command {
 			cmd.Stdin = os.Stdin
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
-			oldstate, err := term.MakeRaw(int(os.Stdin.Fd()))
-			if err != nil {
+			// with a terminal the command gets a PTY and in raw mode Ctrl-C
+			// reaches it as input, otherwise interrupts are passed on as
+			// signals
+			restore := func() {}
+			if term.IsTerminal(int(os.Stdin.Fd())) {
+				cmd.PTY = true
+				cmd.Cols, cmd.Rows, _ = term.GetSize(int(os.Stdin.Fd()))
+				oldstate, err := term.MakeRaw(int(os.Stdin.Fd()))
+				if err != nil {
+					log.Fatal(err)
+				}
+				restore = func() { term.Restore(int(os.Stdin.Fd()), oldstate) }
+			}
+			if _, err := cmd.Start(); err != nil {
+				restore()
 				log.Fatal(err)
 			}
-			status, err := cmd.Run()
-			term.Restore(int(os.Stdin.Fd()), oldstate)
+			if cmd.Rows > 0 {
+				resizes := make(chan os.Signal, 1)
+				notifyResize(resizes)
+				go func() {
+					for range resizes {
+						cols, rows, err := term.GetSize(int(os.Stdin.Fd()))
+						if err != nil {
+							continue
+						}
+						if err := cmd.Resize(rows, cols); err != nil {
+							log.Println(err)
+						}
+					}
+				}()
+			}
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				for sig := range sigs {
+					if err := cmd.Signal(sig.(syscall.Signal)); err != nil {
+						log.Println(err)
+					}
+				}
+			}()
+			status, err := cmd.Wait()
+			signal.Stop(sigs)
+			restore()
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -92,9 +158,15 @@ func runCmd() *cli.Command {
 		},
 	}
 	cmd.Flags().BoolVar(&useCDP, "cdp", false, "use headless chrome")
+	cmd.Flags().StringVar(&memory, "memory", "", "memory size, saved to image (ex: 1G, 256M)")
+	cmd.Flags().StringVar(&vgaMemory, "vga-memory", "", "VGA memory size, saved to image (ex: 16M)")
 	cmd.Flags().BoolVar(&enableNet, "net", false, "enable networking")
 	cmd.Flags().BoolVar(&enableNet, "n", false, "enable networking (shorthand)")
-	cmd.Flags().StringVar(&portForward, "p", "", "forward TCP port (ex: 8080:80)")
+	cmd.Flags().Var(&forwards, "p", "forward a port, can be repeated (ex: 8080:80, 127.0.0.1:5353:53/udp)")
 	cmd.Flags().StringVar(&mountSpec, "m", "", "mount a directory (ex: .:/mnt/host)")
+	cmd.Flags().StringVar(&networkURL, "network-url", "", "join the network of a relay, such as from env86 network (ex: ws://localhost:8086)")
+	cmd.Flags().StringVar(&pcapFile, "pcap", "", "capture network traffic to a pcap file, or pcapng if it ends in .pcapng")
+	netFlags.register(cmd.Flags())
+	condFlags.register(cmd.Flags())
 	return cmd
 }
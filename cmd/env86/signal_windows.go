@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// notifyResize does nothing since Windows has no SIGWINCH
+func notifyResize(c chan<- os.Signal) {}
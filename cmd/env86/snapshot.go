@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/progrium/env86"
+
+	"tractor.dev/toolkit-go/engine/cli"
+)
+
+func snapshotCmd() *cli.Command {
+	cmd := &cli.Command{
+		Usage: "snapshot",
+		Short: "manage named snapshots of an image",
+	}
+	cmd.AddCommand(snapshotListCmd())
+	cmd.AddCommand(snapshotCreateCmd())
+	cmd.AddCommand(snapshotRestoreCmd())
+	cmd.AddCommand(snapshotDeleteCmd())
+	cmd.AddCommand(snapshotPromoteCmd())
+	return cmd
+}
+
+func snapshotListCmd() *cli.Command {
+	cmd := &cli.Command{
+		Usage: "list <image>",
+		Short: "list snapshots in an image",
+		Args:  cli.MinArgs(1),
+		Run: func(ctx *cli.Context, args []string) {
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			snapshots, err := image.Snapshots()
+			if err != nil {
+				log.Fatal(err)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tCREATED\tPARENT\tSIZE\tDESCRIPTION")
+			for _, snap := range snapshots {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+					snap.Name, snap.Time.Format(time.DateTime), snap.Parent, snap.Size, snap.Description)
+			}
+			w.Flush()
+		},
+	}
+	return cmd
+}
+
+func snapshotCreateCmd() *cli.Command {
+	var (
+		from        string
+		description string
+		enableTTY   bool
+		noConsole   bool
+		coldBoot    bool
+		useCDP      bool
+	)
+	cmd := &cli.Command{
+		Usage: "create <image> <name>",
+		Short: "boot an image and save a snapshot on exit",
+		Args:  cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg, err := image.Config()
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Snapshot = from
+			cfg.SaveSnapshot = args[1]
+			cfg.SnapshotDescription = description
+			cfg.ColdBoot = coldBoot
+			cfg.EnableTTY = enableTTY
+			cfg.NoConsole = noConsole
+			cfg.ChromeDP = useCDP
+			bootSnapshot(image, cfg)
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", "", "boot from this snapshot instead of the initial state")
+	cmd.Flags().StringVar(&description, "m", "", "snapshot description")
+	cmd.Flags().BoolVar(&coldBoot, "cold", false, "cold boot without initial state")
+	cmd.Flags().BoolVar(&enableTTY, "ttyS0", false, "open TTY over serial0")
+	cmd.Flags().BoolVar(&noConsole, "no-console", false, "disable console window")
+	cmd.Flags().BoolVar(&useCDP, "cdp", false, "use headless chrome")
+	return cmd
+}
+
+func snapshotRestoreCmd() *cli.Command {
+	var (
+		save      bool
+		enableTTY bool
+		noConsole bool
+		useCDP    bool
+	)
+	cmd := &cli.Command{
+		Usage: "restore <image> <name>",
+		Short: "boot an image from a snapshot",
+		Args:  cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg, err := image.Config()
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Snapshot = args[1]
+			if save {
+				cfg.SaveSnapshot = args[1]
+				if snap, err := image.Snapshot(args[1]); err == nil {
+					cfg.SnapshotDescription = snap.Description
+				}
+			}
+			cfg.EnableTTY = enableTTY
+			cfg.NoConsole = noConsole
+			cfg.ChromeDP = useCDP
+			bootSnapshot(image, cfg)
+		},
+	}
+	cmd.Flags().BoolVar(&save, "save", false, "save back to the snapshot on exit")
+	cmd.Flags().BoolVar(&enableTTY, "ttyS0", false, "open TTY over serial0")
+	cmd.Flags().BoolVar(&noConsole, "no-console", false, "disable console window")
+	cmd.Flags().BoolVar(&useCDP, "cdp", false, "use headless chrome")
+	return cmd
+}
+
+func snapshotDeleteCmd() *cli.Command {
+	cmd := &cli.Command{
+		Usage: "delete <image> <name>",
+		Short: "delete a snapshot from an image",
+		Args:  cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := image.DeleteSnapshot(args[1]); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	return cmd
+}
+
+func snapshotPromoteCmd() *cli.Command {
+	cmd := &cli.Command{
+		Usage: "promote <image> <name>",
+		Short: "make a snapshot the initial state of an image",
+		Args:  cli.MinArgs(2),
+		Run: func(ctx *cli.Context, args []string) {
+			image, err := env86.LoadImage(imagePath(args[0]))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := image.PromoteSnapshot(args[1]); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	return cmd
+}
+
+func bootSnapshot(image *env86.Image, cfg env86.Config) {
+	cfg.ConsoleAddr = env86.ListenAddr()
+	vm, err := env86.New(image, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := vm.Start(); err != nil {
+		log.Fatal(err)
+	}
+	if !cfg.EnableTTY {
+		go exitOnEOF(vm)
+	}
+	if _, err := vm.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
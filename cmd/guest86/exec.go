@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
 	"tractor.dev/toolkit-go/duplex/rpc"
 )
 
@@ -15,6 +25,44 @@ type RunInput struct {
 	Env  []string
 	Dir  string
 	PTY  bool
+	// Rows and Cols are the initial size of the PTY if set
+	Rows int
+	Cols int
+}
+
+// RunMessage is sent on the channel of Run, with input for the command,
+// the end of its input, or a new size for its PTY
+type RunMessage struct {
+	Stdin []byte
+	EOF   bool
+	Rows  int
+	Cols  int
+}
+
+// defaultPath is used when the environment has no PATH, as with services
+// started by some init systems
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// defaultEnv is the environment of commands run without one, which is the
+// environment of the service with a PATH and HOME, and TERM for a PTY
+func defaultEnv(pty bool) []string {
+	env := os.Environ()
+	defaults := map[string]string{
+		"PATH": defaultPath,
+		"HOME": "/",
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		defaults["HOME"] = home
+	}
+	if pty {
+		defaults["TERM"] = "xterm"
+	}
+	for _, key := range []string{"PATH", "HOME", "TERM"} {
+		if _, ok := os.LookupEnv(key); !ok && defaults[key] != "" {
+			env = append(env, key+"="+defaults[key])
+		}
+	}
+	return env
 }
 
 type RunOutput struct {
@@ -30,20 +78,28 @@ func (api *API) Run(r rpc.Responder, c *rpc.Call) {
 	cmd := exec.Command(in.Name, in.Args...)
 	cmd.Dir = in.Dir
 	cmd.Env = in.Env
+	if len(cmd.Env) == 0 {
+		cmd.Env = defaultEnv(in.PTY)
+	}
 
 	var ch io.Closer
 	var err error
+	var output sync.WaitGroup
 	if in.PTY {
-		ch, err = api.runPty(r, cmd)
+		ch, err = api.runPty(r, c, cmd, in, &output)
 	} else {
-		ch, err = api.runNoPty(r, cmd)
+		ch, err = api.runNoPty(r, c, cmd, &output)
 	}
 	if err != nil {
 		r.Return(err)
 		return
 	}
 	defer ch.Close()
+	defer api.untrack(cmd.Process.Pid)
 
+	// all the output is sent before the status, and Wait closes the pipes
+	// so it can't be called until they're read to the end
+	output.Wait()
 	status := 0
 	if err := cmd.Wait(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
@@ -55,11 +111,18 @@ func (api *API) Run(r rpc.Responder, c *rpc.Call) {
 	r.Send(RunOutput{Status: &status})
 }
 
-func (api *API) runPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
-	tty, err := pty.Start(cmd)
+func (api *API) runPty(r rpc.Responder, c *rpc.Call, cmd *exec.Cmd, in RunInput, output *sync.WaitGroup) (io.Closer, error) {
+	var size *pty.Winsize
+	if in.Rows > 0 && in.Cols > 0 {
+		size = &pty.Winsize{Rows: uint16(in.Rows), Cols: uint16(in.Cols)}
+	}
+	// pty.Start makes the command a session leader, which also puts it
+	// in its own process group
+	tty, err := pty.StartWithSize(cmd, size)
 	if err != nil {
 		return nil, err
 	}
+	api.track(cmd.Process.Pid, tty)
 
 	ch, err := r.Continue(cmd.Process.Pid)
 	if err != nil {
@@ -67,15 +130,36 @@ func (api *API) runPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
 	}
 
 	go func() {
-		io.Copy(tty, ch)
+		for {
+			var msg RunMessage
+			if err := c.Receive(&msg); err != nil {
+				return
+			}
+			if len(msg.Stdin) > 0 {
+				tty.Write(msg.Stdin)
+			}
+			if msg.EOF {
+				// end of file on a terminal is Ctrl-D
+				tty.Write([]byte{4})
+			}
+			if msg.Rows > 0 && msg.Cols > 0 {
+				if err := pty.Setsize(tty, &pty.Winsize{Rows: uint16(msg.Rows), Cols: uint16(msg.Cols)}); err != nil {
+					log.Println(err)
+				}
+			}
+		}
 	}()
 
+	output.Add(1)
 	go func() {
+		defer output.Done()
+		defer tty.Close()
 		buf := make([]byte, 1024)
 		for {
 			n, err := tty.Read(buf)
 			if err != nil {
-				if err != io.EOF {
+				// reads fail with EIO once nothing has the terminal open
+				if err != io.EOF && !errors.Is(err, syscall.EIO) {
 					log.Println(err)
 				}
 				return
@@ -87,7 +171,7 @@ func (api *API) runPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
 	return ch, nil
 }
 
-func (api *API) runNoPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
+func (api *API) runNoPty(r rpc.Responder, c *rpc.Call, cmd *exec.Cmd, output *sync.WaitGroup) (io.Closer, error) {
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		panic(err)
@@ -101,11 +185,13 @@ func (api *API) runNoPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
 		panic(err)
 	}
 
-	// todo: set group id for subprocs
-
+	// a session of its own, which is also a process group of its own,
+	// lets signals reach its children and Terminate find all of them
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
+	api.track(cmd.Process.Pid, nil)
 
 	ch, err := r.Continue(cmd.Process.Pid)
 	if err != nil {
@@ -113,11 +199,26 @@ func (api *API) runNoPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
 	}
 
 	go func() {
-		io.Copy(stdin, ch)
-		stdin.Close()
+		defer stdin.Close()
+		for {
+			var msg RunMessage
+			if err := c.Receive(&msg); err != nil {
+				return
+			}
+			if len(msg.Stdin) > 0 {
+				if _, err := stdin.Write(msg.Stdin); err != nil {
+					return
+				}
+			}
+			if msg.EOF {
+				return
+			}
+		}
 	}()
 
+	output.Add(2)
 	go func() {
+		defer output.Done()
 		buf := make([]byte, 1024)
 		for {
 			n, err := stdout.Read(buf)
@@ -132,6 +233,7 @@ func (api *API) runNoPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
 	}()
 
 	go func() {
+		defer output.Done()
 		buf := make([]byte, 1024)
 		for {
 			n, err := stderr.Read(buf)
@@ -148,12 +250,126 @@ func (api *API) runNoPty(r rpc.Responder, cmd *exec.Cmd) (io.Closer, error) {
 	return ch, nil
 }
 
+// track remembers a process started by Run until it's waited on, along
+// with its terminal if it has one
+func (api *API) track(pid int, tty *os.File) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.procs == nil {
+		api.procs = make(map[int]*os.File)
+	}
+	api.procs[pid] = tty
+}
+
+func (api *API) untrack(pid int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	delete(api.procs, pid)
+}
+
+// Signal sends a signal to the process group of a process started by Run.
+// With a terminal it goes to the foreground process group, like a signal
+// from the keyboard, which may be a job started by a shell.
 func (api *API) Signal(pid, sig int) error {
-	// TODO
-	return nil
+	api.mu.Lock()
+	tty, ok := api.procs[pid]
+	api.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no process %d", pid)
+	}
+	pgid := pid
+	if tty != nil {
+		if fg, err := foreground(tty); err == nil && fg > 0 {
+			pgid = fg
+		}
+	}
+	err := syscall.Kill(-pgid, syscall.Signal(sig))
+	if errors.Is(err, syscall.ESRCH) {
+		// the group has no processes left but the process isn't reaped
+		return nil
+	}
+	return err
 }
 
+// Terminate kills every process in the session of a process started by
+// Run, which it leads. That includes jobs a shell started in other process
+// groups, which a signal to its group would miss.
 func (api *API) Terminate(pid int) error {
-	// TODO
+	api.mu.Lock()
+	_, ok := api.procs[pid]
+	api.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no process %d", pid)
+	}
+	err := syscall.Kill(-pid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	// processes can fork while they're being killed, so look again until
+	// there are none left
+	for range 10 {
+		procs, err := sessionProcs(pid)
+		if err != nil {
+			return err
+		}
+		if len(procs) == 0 {
+			break
+		}
+		for _, p := range procs {
+			syscall.Kill(p, syscall.SIGKILL)
+		}
+	}
 	return nil
 }
+
+// sessionProcs returns the processes in a session that haven't exited,
+// found by their session ID in /proc
+func sessionProcs(sid int) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var procs []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			// it exited
+			continue
+		}
+		// the fields after the command name, which can have spaces and
+		// parentheses, are state, ppid, pgrp and session
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) < 4 || fields[0] == "Z" {
+			continue
+		}
+		if s, err := strconv.Atoi(fields[3]); err == nil && s == sid {
+			procs = append(procs, pid)
+		}
+	}
+	return procs, nil
+}
+
+// foreground returns the foreground process group of a terminal
+func foreground(tty *os.File) (int, error) {
+	conn, err := tty.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var pgid int
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		pgid, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pgid, ioctlErr
+}
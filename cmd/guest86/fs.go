@@ -2,7 +2,13 @@ package main
 
 import (
 	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
 
+	"tractor.dev/toolkit-go/duplex/rpc"
 	"tractor.dev/toolkit-go/engine/fs"
 )
 
@@ -12,6 +18,31 @@ type Entry struct {
 	Mtime int
 	Size  int
 	Name  string
+	// Mode is the fs.FileMode of the file
+	Mode uint32
+	UID  int
+	GID  int
+	// Link is the target of a symbolic link
+	Link string
+}
+
+func entryFrom(fi fs.FileInfo, path string) Entry {
+	e := Entry{
+		Name:  fi.Name(),
+		Mtime: int(fi.ModTime().Unix()),
+		IsDir: fi.IsDir(),
+		Size:  int(fi.Size()),
+		Mode:  uint32(fi.Mode()),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		e.UID = int(st.Uid)
+		e.GID = int(st.Gid)
+		e.Ctime = int(st.Ctim.Sec)
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		e.Link, _ = os.Readlink(path)
+	}
+	return e
 }
 
 func (api *API) Stat(path string) (*Entry, error) {
@@ -19,13 +50,18 @@ func (api *API) Stat(path string) (*Entry, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Entry{
-		Name:  fi.Name(),
-		Mtime: int(fi.ModTime().Unix()),
-		IsDir: fi.IsDir(),
-		Ctime: 0,
-		Size:  int(fi.Size()),
-	}, nil
+	e := entryFrom(fi, path)
+	return &e, nil
+}
+
+// Lstat is like Stat but describes a symbolic link instead of following it
+func (api *API) Lstat(path string) (*Entry, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	e := entryFrom(fi, path)
+	return &e, nil
 }
 
 func (api *API) ReadFile(path string) ([]byte, error) {
@@ -39,18 +75,136 @@ func (api *API) ReadDir(path string) ([]Entry, error) {
 	}
 	var entries []Entry
 	for _, e := range dir {
-		fi, _ := e.Info()
-		entries = append(entries, Entry{
-			Name:  fi.Name(),
-			Mtime: int(fi.ModTime().Unix()),
-			IsDir: fi.IsDir(),
-			Ctime: 0,
-			Size:  int(fi.Size()),
-		})
+		fi, err := e.Info()
+		if err != nil {
+			// removed since it was listed
+			continue
+		}
+		entries = append(entries, entryFrom(fi, filepath.Join(path, e.Name())))
 	}
 	return entries, nil
 }
 
+// FileChunk is part of a file streamed by ReadStream or WriteStream. The
+// last chunk has EOF set, or Err if the stream failed.
+type FileChunk struct {
+	Data []byte
+	EOF  bool
+	Err  string
+}
+
+const chunkSize = 32 * 1024
+
+// ReadStream continues with the entry of a file and then streams its
+// contents in chunks, so large files don't have to fit in one message
+func (api *API) ReadStream(r rpc.Responder, c *rpc.Call) {
+	var path string
+	c.Receive(&path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		r.Return(err)
+		return
+	}
+
+	ch, err := r.Continue(entryFrom(fi, path))
+	if err != nil {
+		panic(err)
+	}
+	defer ch.Close()
+	if fi.IsDir() {
+		r.Send(FileChunk{EOF: true})
+		return
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := r.Send(FileChunk{Data: buf[:n]}); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			r.Send(FileChunk{EOF: true})
+			return
+		}
+		if err != nil {
+			r.Send(FileChunk{Err: err.Error()})
+			return
+		}
+	}
+}
+
+type WriteInput struct {
+	Path      string
+	Append    bool
+	Create    bool
+	Exclusive bool
+	Truncate  bool
+	Perm      uint32
+}
+
+// WriteStream opens a file for writing and writes the chunks it receives
+// until one with EOF, then replies with a chunk that has the error of the
+// write if any
+func (api *API) WriteStream(r rpc.Responder, c *rpc.Call) {
+	var in WriteInput
+	c.Receive(&in)
+
+	flag := os.O_WRONLY
+	if in.Append {
+		flag |= os.O_APPEND
+	}
+	if in.Create {
+		flag |= os.O_CREATE
+	}
+	if in.Exclusive {
+		flag |= os.O_EXCL
+	}
+	if in.Truncate {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(in.Path, flag, fs.FileMode(in.Perm))
+	if err != nil {
+		r.Return(err)
+		return
+	}
+
+	ch, err := r.Continue(nil)
+	if err != nil {
+		panic(err)
+	}
+	defer ch.Close()
+	var writeErr error
+	for {
+		var chunk FileChunk
+		if err := c.Receive(&chunk); err != nil {
+			f.Close()
+			return
+		}
+		if len(chunk.Data) > 0 && writeErr == nil {
+			_, writeErr = f.Write(chunk.Data)
+		}
+		if chunk.EOF {
+			break
+		}
+	}
+	if err := f.Close(); writeErr == nil {
+		writeErr = err
+	}
+	result := FileChunk{EOF: true}
+	if writeErr != nil {
+		result.Err = writeErr.Error()
+	}
+	r.Send(result)
+}
+
 func (api *API) WriteFile(path string, data []byte) error {
 	return fs.WriteFile(api.FS, path, data, 0644)
 }
@@ -59,6 +213,45 @@ func (api *API) MakeDir(path string) error {
 	return fs.MkdirAll(api.FS, path, 0744)
 }
 
+func (api *API) Mkdir(path string, perm uint32) error {
+	return os.Mkdir(path, fs.FileMode(perm))
+}
+
+func (api *API) MkdirAll(path string, perm uint32) error {
+	return os.MkdirAll(path, fs.FileMode(perm))
+}
+
+func (api *API) Chmod(path string, mode uint32) error {
+	return os.Chmod(path, fs.FileMode(mode))
+}
+
+func (api *API) Chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
+
+// Lchown is like Chown but changes a symbolic link instead of its target
+func (api *API) Lchown(path string, uid, gid int) error {
+	return os.Lchown(path, uid, gid)
+}
+
+// Chtimes sets the access and modification times in nanoseconds since
+// the Unix epoch
+func (api *API) Chtimes(path string, atime, mtime int64) error {
+	return os.Chtimes(path, time.Unix(0, atime), time.Unix(0, mtime))
+}
+
+func (api *API) Symlink(target, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (api *API) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (api *API) Remove(path string) error {
+	return os.Remove(path)
+}
+
 func (api *API) RemoveAll(path string) error {
 	rfs, ok := api.FS.(interface {
 		RemoveAll(path string) error
@@ -1,17 +1,20 @@
 module guest
 
-go 1.22.1
+go 1.23
+
+replace github.com/progrium/env86 => ../..
 
 require (
 	github.com/creack/pty v1.1.21
+	github.com/progrium/env86 v0.0.0-00010101000000-000000000000
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07
-	tractor.dev/toolkit-go v0.0.0-20240731233937-ae3586204eaa
+	golang.org/x/sys v0.27.0
+	tractor.dev/toolkit-go v0.0.0-20241010005851-214d91207d07
 )
 
 require (
-	github.com/fxamacker/cbor/v2 v2.5.0 // indirect
+	github.com/fxamacker/cbor/v2 v2.7.0 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
-	golang.org/x/net v0.17.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/net v0.30.0 // indirect
 )
@@ -3,9 +3,13 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
+	"os"
 	"os/exec"
+	"sync"
 
 	"github.com/tarm/serial"
+	"golang.org/x/sys/unix"
 	"tractor.dev/toolkit-go/duplex/codec"
 	"tractor.dev/toolkit-go/duplex/fn"
 	"tractor.dev/toolkit-go/duplex/mux"
@@ -16,6 +20,10 @@ import (
 
 var Version = "dev"
 
+// Protocol is the version of the API, which hosts check to know how to
+// call it. It goes up when methods are added or change how they're called.
+const Protocol = 2
+
 func main() {
 	flag.Parse()
 	serialPort := flag.Arg(0)
@@ -41,13 +49,28 @@ func main() {
 
 type API struct {
 	FS fs.FS
+
+	mu           sync.Mutex
+	listeners    map[int]net.Listener
+	lastListener int
+	procs        map[int]*os.File
 }
 
 func (api *API) Version() string {
 	return Version
 }
 
-// this is somewhat specific to Alpine...
+func (api *API) Protocol() int {
+	return Protocol
+}
+
+// SetTime sets the system clock to nanoseconds since the Unix epoch
+func (api *API) SetTime(nsec int64) error {
+	tv := unix.NsecToTimeval(nsec)
+	return unix.Settimeofday(&tv)
+}
+
+// this is specific to Alpine, ConfigureNetwork works on any distro
 func (api *API) ResetNetwork() error {
 	cmd := exec.Command("sh", "-c", "rmmod ne2k-pci && modprobe ne2k-pci && hwclock -s && ifconfig lo up && hostname localhost && setup-interfaces -a -r")
 	_, err := cmd.CombinedOutput()
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+type NetworkOptions struct {
+	Interface     string
+	MAC           string
+	Address       string
+	Gateway       string
+	DNS           []string
+	SearchDomains []string
+	MTU           int
+	Hostname      string
+}
+
+// ConfigureNetwork sets up the network interface with netlink instead of
+// the tools of any particular distro. Empty options are left as they are,
+// but the link is always brought up and its address announced with a
+// gratuitous ARP so the virtual switch learns where the guest is.
+func (api *API) ConfigureNetwork(opts NetworkOptions) error {
+	if err := setLink("lo", nil, 0, true); err != nil {
+		return fmt.Errorf("loopback: %w", err)
+	}
+	if opts.Hostname != "" {
+		if err := unix.Sethostname([]byte(opts.Hostname)); err != nil {
+			return fmt.Errorf("hostname: %w", err)
+		}
+	}
+
+	iface, err := findInterface(opts.Interface)
+	if err != nil {
+		return err
+	}
+	if opts.MAC != "" {
+		mac, err := net.ParseMAC(opts.MAC)
+		if err != nil {
+			return err
+		}
+		// most drivers only take a new address while the link is down
+		if err := setLink(iface.Name, nil, 0, false); err != nil {
+			return fmt.Errorf("%s: %w", iface.Name, err)
+		}
+		if err := setLink(iface.Name, mac, 0, false); err != nil {
+			return fmt.Errorf("%s: set MAC: %w", iface.Name, err)
+		}
+	}
+	if err := setLink(iface.Name, nil, opts.MTU, true); err != nil {
+		return fmt.Errorf("%s: %w", iface.Name, err)
+	}
+
+	if opts.Address != "" {
+		ip, ipnet, err := net.ParseCIDR(opts.Address)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("invalid address: %s", opts.Address)
+		}
+		if err := flushAddrs(iface); err != nil {
+			return fmt.Errorf("%s: %w", iface.Name, err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		if err := addAddr(iface, ip.To4(), ones); err != nil {
+			return fmt.Errorf("%s: add address: %w", iface.Name, err)
+		}
+	}
+	if opts.Gateway != "" {
+		gw := net.ParseIP(opts.Gateway).To4()
+		if gw == nil {
+			return fmt.Errorf("invalid gateway: %s", opts.Gateway)
+		}
+		if err := replaceDefaultRoute(iface, gw); err != nil {
+			return fmt.Errorf("default route: %w", err)
+		}
+	}
+	if len(opts.DNS) > 0 || len(opts.SearchDomains) > 0 {
+		if err := writeResolvConf(opts.DNS, opts.SearchDomains); err != nil {
+			return err
+		}
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			if err := announce(iface, ipnet.IP.To4()); err != nil {
+				return fmt.Errorf("%s: gratuitous ARP: %w", iface.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// findInterface returns the named interface, or the first Ethernet
+// interface if name is empty
+func findInterface(name string) (*net.Interface, error) {
+	if name != "" {
+		return net.InterfaceByName(name)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) == 6 {
+			return &iface, nil
+		}
+	}
+	return nil, errors.New("no network interface found")
+}
+
+func writeResolvConf(servers, search []string) error {
+	var b strings.Builder
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	return os.WriteFile("/etc/resolv.conf", []byte(b.String()), 0644)
+}
+
+// announce broadcasts a gratuitous ARP request for ip
+func announce(iface *net.Interface, ip net.IP) error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	broadcast := [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	sa := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+		Addr:     broadcast,
+	}
+	pkt := make([]byte, 28)
+	binary.BigEndian.PutUint16(pkt[0:], 1)      // Ethernet
+	binary.BigEndian.PutUint16(pkt[2:], 0x0800) // IPv4
+	pkt[4] = 6
+	pkt[5] = 4
+	binary.BigEndian.PutUint16(pkt[6:], 1) // request
+	copy(pkt[8:], iface.HardwareAddr)
+	copy(pkt[14:], ip)
+	copy(pkt[24:], ip)
+	return unix.Sendto(fd, pkt, 0, sa)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// setLink sets the state, MAC address and MTU of a link. A nil MAC or
+// zero MTU are left unchanged.
+func setLink(name string, mac net.HardwareAddr, mtu int, up bool) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, unix.SizeofIfInfomsg)
+	msg[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:], uint32(iface.Index))
+	if up {
+		binary.NativeEndian.PutUint32(msg[8:], unix.IFF_UP)
+	}
+	binary.NativeEndian.PutUint32(msg[12:], unix.IFF_UP)
+	if mac != nil {
+		msg = appendAttr(msg, unix.IFLA_ADDRESS, mac)
+	}
+	if mtu != 0 {
+		msg = appendAttr(msg, unix.IFLA_MTU, nativeUint32(uint32(mtu)))
+	}
+	return netlinkRequest(unix.RTM_NEWLINK, 0, msg)
+}
+
+func flushAddrs(iface *net.Interface) error {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		msg := addrMsg(iface, ipnet.IP.To4(), ones)
+		if err := netlinkRequest(unix.RTM_DELADDR, 0, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addAddr(iface *net.Interface, ip net.IP, prefix int) error {
+	msg := addrMsg(iface, ip, prefix)
+	if prefix < 31 {
+		mask := net.CIDRMask(prefix, 32)
+		brd := make(net.IP, 4)
+		for i := range brd {
+			brd[i] = ip[i] | ^mask[i]
+		}
+		msg = appendAttr(msg, unix.IFA_BROADCAST, brd)
+	}
+	return netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, msg)
+}
+
+func addrMsg(iface *net.Interface, ip net.IP, prefix int) []byte {
+	msg := make([]byte, unix.SizeofIfAddrmsg)
+	msg[0] = unix.AF_INET
+	msg[1] = byte(prefix)
+	msg[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(msg[4:], uint32(iface.Index))
+	msg = appendAttr(msg, unix.IFA_LOCAL, ip)
+	return appendAttr(msg, unix.IFA_ADDRESS, ip)
+}
+
+func replaceDefaultRoute(iface *net.Interface, gw net.IP) error {
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = unix.AF_INET
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_BOOT
+	msg[6] = unix.RT_SCOPE_UNIVERSE
+	msg[7] = unix.RTN_UNICAST
+	msg = appendAttr(msg, unix.RTA_GATEWAY, gw)
+	msg = appendAttr(msg, unix.RTA_OIF, nativeUint32(uint32(iface.Index)))
+	return netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, msg)
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+// appendAttr appends a route attribute padded to 4 bytes
+func appendAttr(msg []byte, typ uint16, data []byte) []byte {
+	attr := make([]byte, unix.SizeofRtAttr, unix.SizeofRtAttr+len(data)+3)
+	binary.NativeEndian.PutUint16(attr[0:], uint16(unix.SizeofRtAttr+len(data)))
+	binary.NativeEndian.PutUint16(attr[2:], typ)
+	attr = append(attr, data...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return append(msg, attr...)
+}
+
+// netlinkRequest sends a route netlink message and waits for its ack
+func netlinkRequest(typ uint16, flags uint16, body []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	binary.NativeEndian.PutUint16(msg[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:], 1)
+	msg = append(msg, body...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != 1 || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short netlink error")
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/progrium/env86/tarutil"
+	"tractor.dev/toolkit-go/duplex/rpc"
+)
+
+// Archive continues with the total size of the regular files under a path
+// and then streams a tar archive of it as chunks. Entries are named from
+// the base name of the path. Symbolic links are archived as links, and
+// special files like devices and sockets are left out.
+func (api *API) Archive(r rpc.Responder, c *rpc.Call) {
+	var root string
+	c.Receive(&root)
+	root = filepath.Clean(root)
+	if root == "/" {
+		r.Return(errors.New("can't archive the root directory"))
+		return
+	}
+
+	var size int64
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		r.Return(err)
+		return
+	}
+
+	ch, err := r.Continue(size)
+	if err != nil {
+		panic(err)
+	}
+	defer ch.Close()
+	w := &chunkWriter{r: r}
+	if err := tarutil.Write(w, root, nil); err != nil {
+		if w.err == nil {
+			r.Send(FileChunk{Err: err.Error()})
+		}
+		return
+	}
+	r.Send(FileChunk{EOF: true})
+}
+
+type ExtractInput struct {
+	Dir string
+	// Name replaces the top level name of the entries if not empty, so an
+	// archive of foo can be extracted as bar
+	Name string
+}
+
+// Extract receives a tar archive as chunks until one with EOF and extracts
+// it into a directory, then replies with a chunk that has the error of the
+// extraction if any. Permissions, symbolic links and mtimes are kept, but
+// files are owned by root.
+func (api *API) Extract(r rpc.Responder, c *rpc.Call) {
+	var in ExtractInput
+	c.Receive(&in)
+
+	fi, err := os.Stat(in.Dir)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	if !fi.IsDir() {
+		r.Return(fmt.Errorf("%s: not a directory", in.Dir))
+		return
+	}
+
+	ch, err := r.Continue(nil)
+	if err != nil {
+		panic(err)
+	}
+	defer ch.Close()
+	cr := &chunkReader{c: c}
+	err = tarutil.Extract(cr, in.Dir, in.Name, nil)
+	// read the rest so the host isn't left blocked sending it
+	if _, derr := io.Copy(io.Discard, cr); derr != nil && cr.recvErr {
+		return
+	}
+	result := FileChunk{EOF: true}
+	if err != nil {
+		result.Err = err.Error()
+	}
+	r.Send(result)
+}
+
+// chunkWriter sends what's written to it as chunks
+type chunkWriter struct {
+	r   rpc.Responder
+	err error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.err = w.r.Send(FileChunk{Data: p}); w.err != nil {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads the data of chunks received until one with EOF
+type chunkReader struct {
+	c       *rpc.Call
+	buf     []byte
+	eof     bool
+	recvErr bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.eof {
+			return 0, io.EOF
+		}
+		var chunk FileChunk
+		if err := cr.c.Receive(&chunk); err != nil {
+			cr.recvErr = true
+			return 0, err
+		}
+		if chunk.Err != "" {
+			cr.eof = true
+			return 0, errors.New(chunk.Err)
+		}
+		cr.buf = chunk.Data
+		cr.eof = chunk.EOF
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -8,31 +9,134 @@ import (
 	"tractor.dev/toolkit-go/duplex/rpc"
 )
 
+type DialInput struct {
+	Network string
+	Addr    string
+}
+
+// streamNetwork checks that a network is stream oriented, since datagram
+// boundaries don't survive a channel
+func streamNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return nil
+	}
+	return fmt.Errorf("unsupported network: %s", network)
+}
+
 func (api *API) Dial(r rpc.Responder, c *rpc.Call) {
-	var addr string
-	c.Receive(&addr)
+	var in DialInput
+	c.Receive(&in)
+	if err := streamNetwork(in.Network); err != nil {
+		r.Return(err)
+		return
+	}
+
+	conn, err := net.Dial(in.Network, in.Addr)
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	defer conn.Close()
+
+	ch, err := r.Continue(conn.LocalAddr().String())
+	if err != nil {
+		panic(err)
+	}
+	join(ch, conn)
+}
+
+type ListenOutput struct {
+	ID   int
+	Addr string
+}
+
+// Listen listens in the guest until the channel is closed. Connections
+// are taken with Accept using the ID of the listener.
+func (api *API) Listen(r rpc.Responder, c *rpc.Call) {
+	var in DialInput
+	c.Receive(&in)
+	if err := streamNetwork(in.Network); err != nil {
+		r.Return(err)
+		return
+	}
 
-	conn, err := net.Dial("tcp", addr)
+	l, err := net.Listen(in.Network, in.Addr)
 	if err != nil {
 		r.Return(err)
 		return
 	}
+	defer l.Close()
+
+	api.mu.Lock()
+	if api.listeners == nil {
+		api.listeners = make(map[int]net.Listener)
+	}
+	api.lastListener++
+	id := api.lastListener
+	api.listeners[id] = l
+	api.mu.Unlock()
+	defer func() {
+		api.mu.Lock()
+		delete(api.listeners, id)
+		api.mu.Unlock()
+	}()
 
-	ch, err := r.Continue()
+	ch, err := r.Continue(ListenOutput{ID: id, Addr: l.Addr().String()})
 	if err != nil {
 		panic(err)
 	}
+	io.Copy(io.Discard, ch)
+	ch.Close()
+}
+
+// Accept waits for a connection to a listener from Listen and returns
+// its remote address
+func (api *API) Accept(r rpc.Responder, c *rpc.Call) {
+	var id int
+	c.Receive(&id)
+
+	api.mu.Lock()
+	l, ok := api.listeners[id]
+	api.mu.Unlock()
+	if !ok {
+		r.Return(fmt.Errorf("no listener %d", id))
+		return
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		r.Return(err)
+		return
+	}
+	defer conn.Close()
+
+	ch, err := r.Continue(conn.RemoteAddr().String())
+	if err != nil {
+		panic(err)
+	}
+	join(ch, conn)
+}
 
+// join copies between a channel and a connection until both directions
+// are done, then closes the channel
+func join(ch io.ReadWriteCloser, conn net.Conn) {
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		io.Copy(ch, conn)
+		// let the other side see EOF
+		if cw, ok := ch.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
 		wg.Done()
 	}()
 	wg.Add(1)
 	go func() {
 		io.Copy(conn, ch)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
 		wg.Done()
 	}()
 
@@ -1,5 +1,7 @@
 package env86
 
+import "github.com/progrium/env86/network"
+
 type Config struct {
 	V86Config
 	NoConsole     bool
@@ -10,6 +12,39 @@ type Config struct {
 	EnableNetwork bool
 	ChromeDP      bool
 	ConsoleAddr   string
+
+	// Snapshot boots from a named snapshot in the image instead of
+	// the initial state. SaveSnapshot names a snapshot to save to on
+	// exit, with SnapshotDescription as its description.
+	Snapshot            string
+	SaveSnapshot        string
+	SnapshotDescription string
+
+	// StateFormat is the format states are saved in
+	StateFormat StateFormat
+
+	// Network is the topology of the virtual network used when
+	// EnableNetwork is set. It's read from "network" in image.json.
+	// If NetworkRelayURL is set, the VM joins the network of that relay
+	// instead of creating one, such as one run by `env86 network`.
+	Network NetworkConfig
+
+	// CaptureFile is a file to write every Ethernet frame of the VM NIC
+	// to, in pcapng format if it ends in .pcapng and pcap otherwise.
+	// NetworkTap is also called with every frame. Neither is available
+	// when joining a network relay, but the relay can capture instead.
+	CaptureFile string
+	NetworkTap  network.Tap `json:"-" cbor:"-"`
+
+	// NetworkConditions emulate a bad network between the VM NIC and the
+	// virtual network, such as latency and packet loss. Like capture,
+	// they're not available when joining a network relay, but the relay
+	// can apply them instead.
+	NetworkConditions *network.Conditions
+
+	// Backend launches the emulator host. If nil, ChromeDP selects
+	// between ChromeDPBackend and WebviewBackend.
+	Backend Backend `json:"-" cbor:"-"`
 }
 
 type V86Config struct {
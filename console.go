@@ -2,7 +2,6 @@ package env86
 
 import (
 	"context"
-	"fmt"
 
 	"tractor.dev/toolkit-go/duplex/fn"
 )
@@ -15,11 +14,16 @@ type Console struct {
 // func (c *Console) Hide() {}
 
 func (c *Console) Screenshot() ([]byte, error) {
-	if c.vm.peer == nil {
-		return nil, fmt.Errorf("not ready")
+	return c.ScreenshotContext(context.Background())
+}
+
+func (c *Console) ScreenshotContext(ctx context.Context) ([]byte, error) {
+	peer := c.vm.peer.Load()
+	if peer == nil {
+		return nil, ErrNotReady
 	}
 	var data []byte
-	_, err := c.vm.peer.Call(context.TODO(), "screenshot", nil, &data)
+	_, err := peer.Call(ctx, "screenshot", nil, &data)
 	if err != nil {
 		return nil, err
 	}
@@ -27,19 +31,29 @@ func (c *Console) Screenshot() ([]byte, error) {
 }
 
 func (c *Console) SetScale(x, y float64) error {
-	if c.vm.peer == nil {
-		return fmt.Errorf("not ready")
+	return c.SetScaleContext(context.Background(), x, y)
+}
+
+func (c *Console) SetScaleContext(ctx context.Context, x, y float64) error {
+	peer := c.vm.peer.Load()
+	if peer == nil {
+		return ErrNotReady
 	}
-	_, err := c.vm.peer.Call(context.TODO(), "setScale", fn.Args{x, y}, nil)
+	_, err := peer.Call(ctx, "setScale", fn.Args{x, y}, nil)
 	return err
 }
 
 // TODO: not working, but webview window might not allow this
 func (c *Console) SetFullscreen() error {
-	if c.vm.peer == nil {
-		return fmt.Errorf("not ready")
+	return c.SetFullscreenContext(context.Background())
+}
+
+func (c *Console) SetFullscreenContext(ctx context.Context) error {
+	peer := c.vm.peer.Load()
+	if peer == nil {
+		return ErrNotReady
 	}
-	_, err := c.vm.peer.Call(context.TODO(), "setFullscreen", nil, nil)
+	_, err := peer.Call(ctx, "setFullscreen", nil, nil)
 	return err
 }
 
@@ -47,10 +61,15 @@ func (c *Console) SetFullscreen() error {
 // func (c *Console) KeyboardEnabled() {}
 
 func (c *Console) SendKeyboard(text string) error {
-	if c.vm.peer == nil {
-		return fmt.Errorf("not ready")
+	return c.SendKeyboardContext(context.Background(), text)
+}
+
+func (c *Console) SendKeyboardContext(ctx context.Context, text string) error {
+	peer := c.vm.peer.Load()
+	if peer == nil {
+		return ErrNotReady
 	}
-	_, err := c.vm.peer.Call(context.TODO(), "sendKeyboard", fn.Args{text}, nil)
+	_, err := peer.Call(ctx, "sendKeyboard", fn.Args{text}, nil)
 	return err
 }
 
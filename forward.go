@@ -0,0 +1,353 @@
+package env86
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/progrium/go-netstack/vnet"
+)
+
+// Forward is a port on the host forwarded to a port on the guest
+type Forward struct {
+	// Protocol is "tcp" or "udp"
+	Protocol string
+	// HostAddr is the address listened on, which has an empty host
+	// to listen on all interfaces
+	HostAddr  string
+	GuestPort int
+}
+
+// ParseForward parses a forward spec of the form
+// [bind:]hostport:guestport[/protocol], such as 8080:80 or
+// 127.0.0.1:5353:53/udp. The protocol defaults to tcp.
+func ParseForward(spec string) (Forward, error) {
+	f := Forward{Protocol: "tcp"}
+	ports, proto, ok := strings.Cut(spec, "/")
+	if ok {
+		f.Protocol = strings.ToLower(proto)
+	}
+	if f.Protocol != "tcp" && f.Protocol != "udp" {
+		return f, fmt.Errorf("invalid forward %q: unknown protocol %s", spec, proto)
+	}
+	i := strings.LastIndex(ports, ":")
+	if i < 0 {
+		return f, fmt.Errorf("invalid forward %q: expected hostport:guestport", spec)
+	}
+	host, guest := ports[:i], ports[i+1:]
+	bind, hostPort := "", host
+	if strings.Contains(host, ":") {
+		var err error
+		bind, hostPort, err = net.SplitHostPort(host)
+		if err != nil {
+			return f, fmt.Errorf("invalid forward %q: %w", spec, err)
+		}
+	}
+	for _, p := range []string{hostPort, guest} {
+		if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+			return f, fmt.Errorf("invalid forward %q: invalid port %q", spec, p)
+		}
+	}
+	f.HostAddr = net.JoinHostPort(bind, hostPort)
+	f.GuestPort, _ = strconv.Atoi(guest)
+	return f, nil
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s:%d/%s", f.HostAddr, f.GuestPort, f.Protocol)
+}
+
+func (f Forward) key() string {
+	return f.Protocol + "/" + f.HostAddr
+}
+
+// Forward starts forwarding a port on the host to the guest as described
+// by a spec in the form accepted by ParseForward. With networking enabled
+// it connects to the guest IP of the network config, or on a network relay
+// without a guest IP, the address leased to the VM. Without networking,
+// TCP connections are made from inside the guest to its loopback by the
+// guest service. UDP is only supported with a local network. Forwards are
+// closed when the VM stops, and can't be added again until it starts.
+func (vm *VM) Forward(spec string) error {
+	f, err := ParseForward(spec)
+	if err != nil {
+		return err
+	}
+	if vm.net == nil && f.Protocol == "udp" {
+		if vm.relay != nil {
+			return fmt.Errorf("forward %s: udp is not supported on a network relay", f)
+		}
+		return fmt.Errorf("forward %s: udp requires networking to be enabled", f)
+	}
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.forwardsClosed {
+		return fmt.Errorf("forward %s: the VM has stopped", f)
+	}
+	if vm.forwards == nil {
+		vm.forwards = make(map[string]*forwarder)
+	}
+	if _, ok := vm.forwards[f.key()]; ok {
+		return fmt.Errorf("already forwarding %s %s", f.Protocol, f.HostAddr)
+	}
+	fw := &forwarder{Forward: f}
+	if f.Protocol == "udp" {
+		err = fw.startUDP(vm.net, net.JoinHostPort(vm.config.Network.GuestIP, strconv.Itoa(f.GuestPort)))
+	} else {
+		err = fw.startTCP(func(ctx context.Context) (net.Conn, error) {
+			return vm.dialGuest(ctx, f.GuestPort)
+		}, func() {
+			vm.removeForward(fw)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	vm.forwards[f.key()] = fw
+	return nil
+}
+
+// Unforward stops a forward and closes its connections. The spec only
+// needs to match the host address and protocol of the forward.
+func (vm *VM) Unforward(spec string) error {
+	f, err := ParseForward(spec)
+	if err != nil {
+		return err
+	}
+	vm.mu.Lock()
+	fw, ok := vm.forwards[f.key()]
+	delete(vm.forwards, f.key())
+	vm.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("not forwarding %s %s", f.Protocol, f.HostAddr)
+	}
+	return fw.close()
+}
+
+// Forwards returns the active forwards sorted by host address
+func (vm *VM) Forwards() []Forward {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	var forwards []Forward
+	for _, fw := range vm.forwards {
+		forwards = append(forwards, fw.Forward)
+	}
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].key() < forwards[j].key()
+	})
+	return forwards
+}
+
+// removeForward removes a forward that stopped on its own
+func (vm *VM) removeForward(fw *forwarder) {
+	vm.mu.Lock()
+	if vm.forwards[fw.key()] == fw {
+		delete(vm.forwards, fw.key())
+	}
+	vm.mu.Unlock()
+}
+
+func (vm *VM) closeForwards() {
+	vm.mu.Lock()
+	forwards := vm.forwards
+	vm.forwards = nil
+	vm.forwardsClosed = true
+	vm.mu.Unlock()
+	for _, fw := range forwards {
+		if err := fw.close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type forwarder struct {
+	Forward
+	close func() error
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// startTCP listens on the host address and proxies connections to what
+// dial returns. If accepting fails for good, stopped is called and the
+// forward is closed.
+func (fw *forwarder) startTCP(dial func(ctx context.Context) (net.Conn, error), stopped func()) error {
+	l, err := net.Listen("tcp", fw.HostAddr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	fw.conns = make(map[net.Conn]struct{})
+	fw.close = func() error {
+		cancel()
+		err := l.Close()
+		fw.mu.Lock()
+		for conn := range fw.conns {
+			conn.Close()
+		}
+		fw.conns = nil
+		fw.mu.Unlock()
+		return err
+	}
+	go func() {
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if temporary(err) {
+					// back off until there are files to spare again
+					delay = min(max(delay*2, 5*time.Millisecond), time.Second)
+					time.Sleep(delay)
+					continue
+				}
+				log.Printf("forward %s: %v", fw, err)
+				stopped()
+				fw.close()
+				return
+			}
+			delay = 0
+			go fw.proxy(conn, func() (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				defer cancel()
+				return dial(ctx)
+			})
+		}
+	}()
+	return nil
+}
+
+// temporary reports whether accepting failed for a reason that can pass,
+// like running out of files
+func temporary(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (fw *forwarder) proxy(conn net.Conn, dial func() (net.Conn, error)) {
+	defer conn.Close()
+	backend, err := dial()
+	if err != nil {
+		log.Printf("forward %s: %v", fw, err)
+		return
+	}
+	defer backend.Close()
+	if !fw.track(conn, backend) {
+		return
+	}
+	defer fw.untrack(conn, backend)
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// track records open connections so they're closed with the forward. It
+// returns false if the forward is already closed.
+func (fw *forwarder) track(conns ...net.Conn) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		fw.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (fw *forwarder) untrack(conns ...net.Conn) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for _, c := range conns {
+		delete(fw.conns, c)
+	}
+}
+
+// startUDP uses the port forwarding service of the virtual network since
+// vnet can only dial TCP. The service proxies datagrams from a host
+// listener into the network and tracks the reply flows itself.
+func (fw *forwarder) startUDP(vn *vnet.VirtualNetwork, target string) error {
+	if err := forwardService(vn, "expose", map[string]any{
+		"local":    fw.HostAddr,
+		"remote":   target,
+		"protocol": "udp",
+	}); err != nil {
+		return err
+	}
+	fw.close = func() error {
+		return forwardService(vn, "unexpose", map[string]any{
+			"local":    fw.HostAddr,
+			"protocol": "udp",
+		})
+	}
+	return nil
+}
+
+func forwardService(vn *vnet.VirtualNetwork, action string, req map[string]any) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(http.MethodPost, "/services/forwarder/"+action, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	w := &serviceResponse{}
+	vn.Mux().ServeHTTP(w, r)
+	// a handler that writes nothing responds OK
+	w.WriteHeader(http.StatusOK)
+	if w.code != http.StatusOK {
+		return fmt.Errorf("forward %s: %s", req["local"], strings.TrimSpace(w.body.String()))
+	}
+	return nil
+}
+
+// serviceResponse keeps the response of a virtual network service called
+// in process
+type serviceResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *serviceResponse) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *serviceResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *serviceResponse) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
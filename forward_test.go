@@ -0,0 +1,37 @@
+package env86
+
+import "testing"
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Forward
+		err  bool
+	}{
+		{spec: "8080:80", want: Forward{Protocol: "tcp", HostAddr: ":8080", GuestPort: 80}},
+		{spec: "8080:80/tcp", want: Forward{Protocol: "tcp", HostAddr: ":8080", GuestPort: 80}},
+		{spec: "5353:53/UDP", want: Forward{Protocol: "udp", HostAddr: ":5353", GuestPort: 53}},
+		{spec: "127.0.0.1:5353:53/udp", want: Forward{Protocol: "udp", HostAddr: "127.0.0.1:5353", GuestPort: 53}},
+		{spec: "[::1]:8080:80", want: Forward{Protocol: "tcp", HostAddr: "[::1]:8080", GuestPort: 80}},
+		{spec: "localhost:0:22", want: Forward{Protocol: "tcp", HostAddr: "localhost:0", GuestPort: 22}},
+		{spec: "80", err: true},
+		{spec: "8080:80/sctp", err: true},
+		{spec: "8080:http", err: true},
+		{spec: "70000:80", err: true},
+		{spec: "8080:-1", err: true},
+		{spec: "127.0.0.1:80", err: true},
+		{spec: "::1:8080:80", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseForward(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseForward(%q) = %+v, want error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseForward(%q) = %+v, %v, want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+}
@@ -12,6 +12,7 @@ require (
 	github.com/klauspost/compress v1.17.11
 	github.com/progrium/go-netstack v0.0.0-20240720002214-37b2b8227b91
 	golang.org/x/net v0.30.0
+	golang.org/x/sys v0.27.0
 	golang.org/x/term v0.25.0
 	tractor.dev/toolkit-go v0.0.0-20241010005851-214d91207d07
 	tractor.dev/toolkit-go/desktop v0.0.0-20241125202453-a7a809374e73
@@ -42,7 +43,6 @@ require (
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/mod v0.21.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.27.0 // indirect
 	golang.org/x/time v0.7.0 // indirect
 	golang.org/x/tools v0.26.0 // indirect
 )
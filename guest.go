@@ -1,19 +1,26 @@
 package env86
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hugelgupf/p9/fsimpl/localfs"
 	"github.com/hugelgupf/p9/p9"
 	"golang.org/x/net/websocket"
 	"tractor.dev/toolkit-go/duplex/codec"
+	"tractor.dev/toolkit-go/duplex/fn"
 	"tractor.dev/toolkit-go/duplex/mux"
+	"tractor.dev/toolkit-go/duplex/rpc"
 	"tractor.dev/toolkit-go/duplex/talk"
 )
 
@@ -23,83 +30,478 @@ func (vm *VM) handleGuest(conn *websocket.Conn) {
 	defer sess.Close()
 
 	vm.guest = &Guest{
-		vm:   vm,
-		peer: talk.NewPeer(sess, codec.CBORCodec{}),
+		vm:    vm,
+		peer:  talk.NewPeer(sess, codec.CBORCodec{}),
+		ready: make(chan struct{}),
 	}
-	vm.guest.cond = sync.NewCond(&vm.guest.mu)
 
-	var v string
-	_, err := vm.guest.peer.Call(context.TODO(), "vm.Version", nil, &v)
-	if err != nil {
+	if err := vm.guest.handshake(context.Background()); err != nil {
 		log.Println("guest:", err)
 		return
 	}
-	vm.guest.ver = v
-	vm.guest.ready = true
-	vm.guest.cond.Broadcast()
+	close(vm.guest.ready)
 	vm.guest.peer.Respond()
 }
 
+// handleGuestProxy passes calls through to the guest service so other
+// processes on this host can use it with DialGuest. Once a call continues,
+// its channel is joined to the one to the guest.
+func (vm *VM) handleGuestProxy(conn *websocket.Conn) {
+	conn.PayloadType = websocket.BinaryFrame
+	sess := mux.New(conn)
+	defer sess.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := talk.NewPeer(sess, codec.CBORCodec{})
+	peer.Handle("vm", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+		var args any
+		c.Receive(&args)
+		guest := vm.guest
+		if guest == nil {
+			r.Return(errors.New("guest not found"))
+			return
+		}
+		if err := guest.ReadyContext(ctx); err != nil {
+			r.Return(err)
+			return
+		}
+		method := c.Selector[strings.LastIndex(c.Selector, ".")+1:]
+		var reply any
+		resp, err := guest.peer.Call(ctx, "vm."+method, args, &reply)
+		if err != nil {
+			r.Return(err)
+			return
+		}
+		if !resp.Continue {
+			r.Return(reply)
+			return
+		}
+		ch, err := r.Continue(reply)
+		if err != nil {
+			resp.Channel.Close()
+			return
+		}
+		go func() {
+			io.Copy(ch, resp.Channel)
+			ch.Close()
+		}()
+		io.Copy(resp.Channel, ch)
+		resp.Channel.Close()
+	}))
+	peer.Respond()
+}
+
+// DialGuest connects to the guest service of a VM running in another
+// process on this host, given the address of its console server. Only
+// the guest service is available through it, so the Guest has no VM.
+func DialGuest(addr string) (*Guest, error) {
+	addr = LocalhostAddr(addr)
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	conn, err := websocket.Dial(fmt.Sprintf("ws://%s/guest/proxy", addr), "", fmt.Sprintf("http://%s/", addr))
+	if err != nil {
+		return nil, err
+	}
+	conn.PayloadType = websocket.BinaryFrame
+
+	g := &Guest{
+		peer:  talk.NewPeer(mux.New(conn), codec.CBORCodec{}),
+		ready: make(chan struct{}),
+	}
+	go g.peer.Respond()
+	if err := g.handshake(context.Background()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	close(g.ready)
+	return g, nil
+}
+
+// guestProtocol is the newest guest service protocol this package speaks.
+// Guest services from before it was versioned speak protocol 1, which has
+// no SetTime or ConfigureNetwork, only dials TCP given an address, and
+// reads the stdin of commands as raw bytes.
+const guestProtocol = 2
+
+// killTimeout is how long a command whose context is done is given to be
+// killed before it's left to the guest
+const killTimeout = 5 * time.Second
+
 type Guest struct {
 	vm    *VM
 	peer  *talk.Peer
 	ver   string
-	ready bool
-	mu    sync.Mutex
-	cond  *sync.Cond
+	proto int
+	ready chan struct{}
+}
+
+// handshake gets the version and protocol of the guest service. A guest
+// service without the Protocol method speaks protocol 1.
+func (g *Guest) handshake(ctx context.Context) error {
+	if _, err := g.peer.Call(ctx, "vm.Version", nil, &g.ver); err != nil {
+		return err
+	}
+	if _, err := g.peer.Call(ctx, "vm.Protocol", nil, &g.proto); err != nil {
+		g.proto = 1
+	}
+	g.proto = min(g.proto, guestProtocol)
+	return nil
+}
+
+// requireProtocol waits for the handshake and returns an error matching
+// errors.ErrUnsupported if the guest service speaks a protocol older than
+// proto
+func (g *Guest) requireProtocol(ctx context.Context, proto int, what string) error {
+	if err := g.ReadyContext(ctx); err != nil {
+		return err
+	}
+	if g.proto < proto {
+		return fmt.Errorf("%s needs a newer guest service: %w", what, errors.ErrUnsupported)
+	}
+	return nil
 }
 
 func (g *Guest) Ready() bool {
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	for !g.ready {
-		g.cond.Wait()
+	<-g.ready
+	return true
+}
+
+// ReadyContext waits for the guest service to finish its handshake
+func (g *Guest) ReadyContext(ctx context.Context) error {
+	select {
+	case <-g.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return g.ready
 }
 
 func (g *Guest) Version() string {
 	return g.ver
 }
 
+// Protocol waits for the handshake and returns the version of the guest
+// service protocol spoken with the guest, which is older than the newest
+// when the guest service is
+func (g *Guest) Protocol() int {
+	<-g.ready
+	return g.proto
+}
+
+// GuestCmd is a command run in the guest, which works like exec.Cmd. The
+// command is given the environment of the guest service if Env is empty,
+// with a default PATH if it has none.
 type GuestCmd struct {
 	guestRunInput
-	guest  *Guest
-	Stdin  io.Reader
+	guest *Guest
+	ctx   context.Context
+
+	// Stdin is read until EOF and sent to the command, which reads EOF
+	// after that. If nil, the command reads EOF right away. With a PTY,
+	// EOF is sent as Ctrl-D, and only if Stdin is set and reaches EOF, so
+	// the terminal is left alone without it.
+	Stdin io.Reader
+	// Stdout and Stderr receive the output of the command. If nil, the
+	// output is discarded. With a PTY all output goes to Stdout.
 	Stdout io.Writer
 	Stderr io.Writer
+
+	pid        int
+	resp       *rpc.Response
+	sendMu     sync.Mutex
+	done       chan struct{}
+	status     int
+	err        error
+	closeAfter []io.Closer
 }
 
+// ExitError is returned by Output and CombinedOutput when a guest command
+// exits with a non-zero status
+type ExitError struct {
+	Status int
+	// Stderr is the error output of the command if Stderr wasn't set
+	Stderr []byte
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// Run starts the command and waits for it to exit
 func (gc *GuestCmd) Run() (status int, err error) {
-	// todo: change to start, get pid and return
-	resp, err := gc.guest.peer.Call(context.Background(), "vm.Run", gc.guestRunInput, nil)
-	if err != nil {
+	if _, err := gc.Start(); err != nil {
 		return -1, err
 	}
-	defer resp.Channel.Close()
+	return gc.Wait()
+}
+
+// Output runs the command and returns its standard output. If the command
+// exits with a non-zero status the error is an *ExitError.
+func (gc *GuestCmd) Output() ([]byte, error) {
+	if gc.Stdout != nil {
+		return nil, errors.New("guest command Stdout already set")
+	}
+	var stdout bytes.Buffer
+	gc.Stdout = &stdout
+	var stderr *bytes.Buffer
+	if gc.Stderr == nil {
+		stderr = new(bytes.Buffer)
+		gc.Stderr = stderr
+	}
+	status, err := gc.Run()
+	if err == nil && status != 0 {
+		exitErr := &ExitError{Status: status}
+		if stderr != nil {
+			exitErr.Stderr = stderr.Bytes()
+		}
+		err = exitErr
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// error combined. If the command exits with a non-zero status the error is
+// an *ExitError.
+func (gc *GuestCmd) CombinedOutput() ([]byte, error) {
+	if gc.Stdout != nil {
+		return nil, errors.New("guest command Stdout already set")
+	}
+	if gc.Stderr != nil {
+		return nil, errors.New("guest command Stderr already set")
+	}
+	var out bytes.Buffer
+	gc.Stdout = &out
+	gc.Stderr = &out
+	status, err := gc.Run()
+	if err == nil && status != 0 {
+		err = &ExitError{Status: status}
+	}
+	return out.Bytes(), err
+}
+
+// StdinPipe returns a pipe to the standard input of the command once it
+// starts. Closing the pipe sends EOF to the command. The pipe is closed
+// when the command exits.
+func (gc *GuestCmd) StdinPipe() (io.WriteCloser, error) {
 	if gc.Stdin != nil {
-		go func() {
-			io.Copy(resp.Channel, os.Stdin)
-		}()
+		return nil, errors.New("guest command Stdin already set")
+	}
+	if gc.done != nil {
+		return nil, errors.New("StdinPipe after guest command started")
+	}
+	pr, pw := io.Pipe()
+	gc.Stdin = pr
+	gc.closeAfter = append(gc.closeAfter, pr)
+	return pw, nil
+}
+
+// StdoutPipe returns a pipe from the standard output of the command once
+// it starts. The pipe is closed when the command exits, so all reads from
+// it must be done before calling Wait.
+func (gc *GuestCmd) StdoutPipe() (io.ReadCloser, error) {
+	if gc.Stdout != nil {
+		return nil, errors.New("guest command Stdout already set")
+	}
+	if gc.done != nil {
+		return nil, errors.New("StdoutPipe after guest command started")
+	}
+	pr, pw := io.Pipe()
+	gc.Stdout = pw
+	gc.closeAfter = append(gc.closeAfter, pw)
+	return pr, nil
+}
+
+// StderrPipe is like StdoutPipe for the standard error of the command
+func (gc *GuestCmd) StderrPipe() (io.ReadCloser, error) {
+	if gc.Stderr != nil {
+		return nil, errors.New("guest command Stderr already set")
+	}
+	if gc.done != nil {
+		return nil, errors.New("StderrPipe after guest command started")
+	}
+	pr, pw := io.Pipe()
+	gc.Stderr = pw
+	gc.closeAfter = append(gc.closeAfter, pw)
+	return pr, nil
+}
+
+// Start starts the command in the guest and returns its PID without
+// waiting for it to exit. The command leads a session of its own, so
+// Signal reaches the processes it starts and Kill reaches all of them.
+func (gc *GuestCmd) Start() (pid int, err error) {
+	if gc.done != nil {
+		return 0, errors.New("guest command already started")
 	}
+	if err := gc.guest.ReadyContext(gc.ctx); err != nil {
+		gc.closePipes()
+		return 0, err
+	}
+	resp, err := gc.guest.peer.Call(gc.ctx, "vm.Run", gc.guestRunInput, &gc.pid)
+	if err != nil {
+		gc.closePipes()
+		return 0, err
+	}
+	gc.resp = resp
+	gc.done = make(chan struct{})
+	// kill the command if ctx is done before it exits
+	stop := context.AfterFunc(gc.ctx, func() {
+		// it may have just exited, and a guest that doesn't answer
+		// shouldn't keep the channel open
+		ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+		defer cancel()
+		gc.KillContext(ctx)
+		resp.Channel.Close()
+	})
+	go gc.sendStdin()
+	go func() {
+		defer close(gc.done)
+		defer gc.closePipes()
+		defer stop()
+		defer resp.Channel.Close()
+		stdout, stderr := gc.Stdout, gc.Stderr
+		if stdout == nil {
+			stdout = io.Discard
+		}
+		if stderr == nil {
+			stderr = io.Discard
+		}
+		for {
+			var out guestRunOutput
+			err := resp.Receive(&out)
+			if err != nil {
+				gc.status = -1
+				gc.err = err
+				if gc.ctx.Err() != nil {
+					gc.err = gc.ctx.Err()
+				}
+				return
+			}
+			if len(out.Stdout) > 0 {
+				stdout.Write(out.Stdout)
+				continue
+			}
+			if len(out.Stderr) > 0 {
+				stderr.Write(out.Stderr)
+				continue
+			}
+			if out.Status != nil {
+				gc.status = *(out.Status)
+				return
+			}
+		}
+	}()
+	return gc.pid, nil
+}
+
+// sendStdin sends Stdin to the command followed by EOF
+func (gc *GuestCmd) sendStdin() {
+	if gc.guest.proto < 2 {
+		gc.writeStdin()
+		return
+	}
+	if gc.Stdin == nil {
+		if !gc.PTY {
+			gc.send(guestRunMessage{EOF: true})
+		}
+		return
+	}
+	buf := make([]byte, 32*1024)
 	for {
-		var out guestRunOutput
-		err := resp.Receive(&out)
-		if err != nil {
-			return -1, err
+		n, err := gc.Stdin.Read(buf)
+		if n > 0 {
+			if err := gc.send(guestRunMessage{Stdin: buf[:n]}); err != nil {
+				return
+			}
 		}
-		if len(out.Stdout) > 0 {
-			gc.Stdout.Write(out.Stdout)
-			continue
+		if err == io.EOF || (err != nil && !gc.PTY) {
+			gc.send(guestRunMessage{EOF: true})
+			return
 		}
-		if len(out.Stderr) > 0 {
-			gc.Stderr.Write(out.Stderr)
-			continue
+		if err != nil {
+			return
 		}
-		if out.Status != nil {
-			return *(out.Status), nil
+	}
+}
+
+// writeStdin copies Stdin to a guest service older than protocol 2, which
+// reads the channel as raw input and only sees EOF when it's closed for
+// writing
+func (gc *GuestCmd) writeStdin() {
+	if gc.Stdin != nil {
+		if _, err := io.Copy(gc.resp.Channel, gc.Stdin); err != nil {
+			return
 		}
 	}
+	if cw, ok := any(gc.resp.Channel).(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+func (gc *GuestCmd) closePipes() {
+	for _, c := range gc.closeAfter {
+		c.Close()
+	}
+}
+
+// Wait waits for a started command to exit and returns its exit status
+func (gc *GuestCmd) Wait() (status int, err error) {
+	if gc.done == nil {
+		return -1, errors.New("guest command not started")
+	}
+	<-gc.done
+	return gc.status, gc.err
+}
+
+// Resize sets the size of the PTY of a started command
+func (gc *GuestCmd) Resize(rows, cols int) error {
+	if gc.done == nil {
+		return errors.New("guest command not started")
+	}
+	if rows <= 0 || cols <= 0 {
+		return fmt.Errorf("invalid terminal size: %dx%d", cols, rows)
+	}
+	if err := gc.guest.requireProtocol(gc.ctx, 2, "resizing the terminal"); err != nil {
+		return err
+	}
+	return gc.send(guestRunMessage{Rows: rows, Cols: cols})
+}
+
+func (gc *GuestCmd) send(msg guestRunMessage) error {
+	gc.sendMu.Lock()
+	defer gc.sendMu.Unlock()
+	return gc.resp.Send(msg)
+}
+
+// Signal sends a signal to the process group of a started command, or
+// with a PTY, to the foreground process group of its terminal. Signals
+// are sent by number, which is the same on all hosts for common signals
+// like SIGINT, SIGTERM, SIGHUP and SIGKILL.
+func (gc *GuestCmd) Signal(sig syscall.Signal) error {
+	return gc.SignalContext(context.Background(), sig)
+}
+
+func (gc *GuestCmd) SignalContext(ctx context.Context, sig syscall.Signal) error {
+	if gc.done == nil {
+		return errors.New("guest command not started")
+	}
+	_, err := gc.guest.peer.Call(ctx, "vm.Signal", fn.Args{gc.pid, int(sig)}, nil)
+	return err
+}
+
+// Kill kills a started command along with the processes it started
+func (gc *GuestCmd) Kill() error {
+	return gc.KillContext(context.Background())
+}
+
+func (gc *GuestCmd) KillContext(ctx context.Context) error {
+	if gc.done == nil {
+		return errors.New("guest command not started")
+	}
+	_, err := gc.guest.peer.Call(ctx, "vm.Terminate", fn.Args{gc.pid}, nil)
+	return err
 }
 
 type guestRunInput struct {
@@ -108,6 +510,17 @@ type guestRunInput struct {
 	Dir  string
 	Env  []string
 	PTY  bool
+	// Rows and Cols are the initial size of the PTY if set, which guest
+	// services older than protocol 2 ignore
+	Rows int
+	Cols int
+}
+
+type guestRunMessage struct {
+	Stdin []byte
+	EOF   bool
+	Rows  int
+	Cols  int
 }
 
 type guestRunOutput struct {
@@ -116,23 +529,95 @@ type guestRunOutput struct {
 	Status *int
 }
 
+// Command returns a command to run a program in the guest. The command
+// doesn't have a PTY unless PTY is set before it starts.
 func (g *Guest) Command(name string, args ...string) *GuestCmd {
+	return g.CommandContext(context.Background(), name, args...)
+}
+
+// CommandContext is like Command but the command is killed and its
+// channel closed if ctx is done before it completes.
+func (g *Guest) CommandContext(ctx context.Context, name string, args ...string) *GuestCmd {
 	return &GuestCmd{
 		guestRunInput: guestRunInput{
 			Name: name,
 			Args: args,
-			PTY:  true,
 		},
 		guest: g,
+		ctx:   ctx,
 	}
 }
 
+// GuestNetworkOptions configure the network interface of the guest. Empty
+// fields leave the current settings of the guest as they are.
+type GuestNetworkOptions struct {
+	// Interface is the name of the interface to configure, which defaults
+	// to the first Ethernet interface
+	Interface string
+	// MAC is a hardware address to give the interface
+	MAC string
+	// Address is the IPv4 address of the interface in CIDR notation,
+	// which replaces any other IPv4 addresses it has
+	Address string
+	// Gateway is the IP of the default route
+	Gateway string
+	// DNS servers and SearchDomains replace /etc/resolv.conf if given
+	DNS           []string
+	SearchDomains []string
+	MTU           int
+	Hostname      string
+}
+
+// ConfigureNetwork sets up networking in the guest without relying on the
+// tools of its distro. The interface is brought up and announced with a
+// gratuitous ARP so the virtual network can reach the guest right away.
+// Guest services older than protocol 2 don't support it, in which case
+// ResetNetwork is the closest there is.
+func (g *Guest) ConfigureNetwork(opts GuestNetworkOptions) error {
+	return g.ConfigureNetworkContext(context.Background(), opts)
+}
+
+func (g *Guest) ConfigureNetworkContext(ctx context.Context, opts GuestNetworkOptions) error {
+	if err := g.requireProtocol(ctx, 2, "configuring the network"); err != nil {
+		return err
+	}
+	_, err := g.peer.Call(ctx, "vm.ConfigureNetwork", fn.Args{opts}, nil)
+	return err
+}
+
+// SyncClock sets the guest clock to the host time, which is needed after
+// restoring a saved state. Guest services older than protocol 2 don't
+// support it, but ResetNetwork also sets the clock from the hardware clock.
+func (g *Guest) SyncClock() error {
+	return g.SyncClockContext(context.Background())
+}
+
+func (g *Guest) SyncClockContext(ctx context.Context) error {
+	if err := g.requireProtocol(ctx, 2, "setting the clock"); err != nil {
+		return err
+	}
+	_, err := g.peer.Call(ctx, "vm.SetTime", fn.Args{time.Now().UnixNano()}, nil)
+	return err
+}
+
+// ResetNetwork reloads the NIC driver and reruns the network setup of an
+// Alpine guest. Use ConfigureNetwork, which works on any distro.
 func (g *Guest) ResetNetwork() error {
-	_, err := g.peer.Call(context.Background(), "vm.ResetNetwork", nil, nil)
+	return g.ResetNetworkContext(context.Background())
+}
+
+func (g *Guest) ResetNetworkContext(ctx context.Context) error {
+	_, err := g.peer.Call(ctx, "vm.ResetNetwork", nil, nil)
 	return err
 }
 
 func (g *Guest) Mount(src, dst string) error {
+	return g.MountContext(context.Background(), src, dst)
+}
+
+// MountContext serves src to the guest over 9P at dst until the mount
+// goes away or ctx is done.
+func (g *Guest) MountContext(ctx context.Context, src, dst string) error {
 	l, err := net.Listen("tcp", ":0")
 	if err != nil {
 		return err
@@ -148,11 +633,15 @@ func (g *Guest) Mount(src, dst string) error {
 			log.Fatal(err)
 		}
 	}()
-	resp, err := g.peer.Call(context.Background(), "vm.Mount9P", dst, nil)
+	resp, err := g.peer.Call(ctx, "vm.Mount9P", dst, nil)
 	if err != nil {
 		return err
 	}
 	ch := resp.Channel
+	stop := context.AfterFunc(ctx, func() {
+		ch.Close()
+	})
+	defer stop()
 	conn, err := net.Dial("tcp", net.JoinHostPort("localhost", port))
 	if err != nil {
 		return err
@@ -175,5 +664,154 @@ func (g *Guest) Mount(src, dst string) error {
 	return ch.Close()
 }
 
-// FS(path) fs.FS
-// Dial(addr) Conn, error
+type guestDialInput struct {
+	Network string
+	Addr    string
+}
+
+type guestListenOutput struct {
+	ID   int
+	Addr string
+}
+
+// Dial connects to an address from inside the guest through the guest
+// service, which works without networking. Only stream networks like tcp
+// and unix are supported, and only tcp by guest services older than
+// protocol 2.
+func (g *Guest) Dial(network, addr string) (net.Conn, error) {
+	return g.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but gives up connecting if ctx is done. Once
+// connected, ctx has no effect on the connection.
+func (g *Guest) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		if err := g.requireProtocol(ctx, 2, "dialing "+network); err != nil {
+			return nil, err
+		}
+	} else if err := g.ReadyContext(ctx); err != nil {
+		return nil, err
+	}
+	var local string
+	var args any = guestDialInput{Network: network, Addr: addr}
+	if g.proto < 2 {
+		// only the address, and the local address isn't sent back
+		args = addr
+	}
+	resp, err := g.peer.Call(ctx, "vm.Dial", args, &local)
+	if err != nil {
+		return nil, err
+	}
+	return newGuestConn(resp.Channel, guestAddr{network, local}, guestAddr{network, addr}), nil
+}
+
+// Listen listens on an address inside the guest and tunnels connections
+// to the host through the guest service until the listener is closed. It
+// needs a guest service of protocol 2 or newer.
+func (g *Guest) Listen(network, addr string) (net.Listener, error) {
+	return g.ListenContext(context.Background(), network, addr)
+}
+
+// ListenContext is like Listen but the listener is also closed when ctx
+// is done.
+func (g *Guest) ListenContext(ctx context.Context, network, addr string) (net.Listener, error) {
+	if err := g.requireProtocol(ctx, 2, "listening"); err != nil {
+		return nil, err
+	}
+	var out guestListenOutput
+	resp, err := g.peer.Call(ctx, "vm.Listen", guestDialInput{Network: network, Addr: addr}, &out)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	l := &guestListener{
+		guest:  g,
+		ch:     resp.Channel,
+		id:     out.ID,
+		addr:   guestAddr{network, out.Addr},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	context.AfterFunc(ctx, func() {
+		l.ch.Close()
+	})
+	return l, nil
+}
+
+type guestListener struct {
+	guest  *Guest
+	ch     io.Closer
+	id     int
+	addr   net.Addr
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (l *guestListener) Accept() (net.Conn, error) {
+	var remote string
+	resp, err := l.guest.peer.Call(l.ctx, "vm.Accept", l.id, &remote)
+	if err != nil {
+		if l.ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		return nil, err
+	}
+	return newGuestConn(resp.Channel, l.addr, guestAddr{l.addr.Network(), remote}), nil
+}
+
+// Close stops the listener in the guest. Connections already accepted
+// stay open.
+func (l *guestListener) Close() error {
+	if l.ctx.Err() != nil {
+		return net.ErrClosed
+	}
+	l.cancel()
+	return nil
+}
+
+func (l *guestListener) Addr() net.Addr {
+	return l.addr
+}
+
+// guestConn is a connection tunneled over a guest service channel. The
+// channel is joined to one end of a pipe so the connection gets deadlines.
+type guestConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func newGuestConn(ch io.ReadWriteCloser, local, remote net.Addr) net.Conn {
+	conn, pipe := net.Pipe()
+	go func() {
+		io.Copy(ch, pipe)
+		ch.Close()
+	}()
+	go func() {
+		io.Copy(pipe, ch)
+		pipe.Close()
+	}()
+	return &guestConn{Conn: conn, local: local, remote: remote}
+}
+
+func (c *guestConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *guestConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// guestAddr is an address inside the guest
+type guestAddr struct {
+	network string
+	addr    string
+}
+
+func (a guestAddr) Network() string {
+	return a.network
+}
+
+func (a guestAddr) String() string {
+	return a.addr
+}
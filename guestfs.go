@@ -0,0 +1,488 @@
+package env86
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"tractor.dev/toolkit-go/duplex/fn"
+	"tractor.dev/toolkit-go/duplex/rpc"
+	"tractor.dev/toolkit-go/engine/fs"
+)
+
+// GuestFS is the filesystem of the guest over the guest service. Names are
+// slash separated and relative to the guest root, as with io/fs, so "etc/hosts"
+// is /etc/hosts in the guest. File contents are streamed in chunks, so large
+// files don't have to fit in memory.
+type GuestFS struct {
+	guest *Guest
+}
+
+var _ fs.MutableFS = (*GuestFS)(nil)
+
+// GuestStat is what the Sys method of file infos from GuestFS returns
+type GuestStat struct {
+	UID int
+	GID int
+	// Link is the target of a symbolic link from Lstat or ReadDir
+	Link string
+}
+
+// FS returns the filesystem of the guest
+func (g *Guest) FS() *GuestFS {
+	return &GuestFS{guest: g}
+}
+
+type guestEntry struct {
+	IsDir bool
+	Ctime int
+	Mtime int
+	Size  int
+	Name  string
+	Mode  uint32
+	UID   int
+	GID   int
+	Link  string
+}
+
+type guestFileChunk struct {
+	Data []byte
+	EOF  bool
+	Err  string
+}
+
+type guestWriteInput struct {
+	Path      string
+	Append    bool
+	Create    bool
+	Exclusive bool
+	Truncate  bool
+	Perm      uint32
+}
+
+// guestChunkSize is the most data sent in one chunk to the guest
+const guestChunkSize = 32 * 1024
+
+func (fsys *GuestFS) call(op, name, method string, args any, reply any) (*rpc.Response, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	resp, err := fsys.guest.peer.Call(context.Background(), "vm."+method, args, reply)
+	if err != nil {
+		return nil, guestPathError(op, name, err)
+	}
+	return resp, nil
+}
+
+// guestPath is the absolute path in the guest of a name
+func guestPath(name string) string {
+	return path.Join("/", name)
+}
+
+// guestPathError turns an error from the guest into a path error for
+// name, recognizing the common errors so errors.Is works with them
+func guestPathError(op, name string, err error) error {
+	msg := err.Error()
+	// the guest error is from os and already has its own op and path
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	switch msg {
+	case "no such file or directory":
+		err = fs.ErrNotExist
+	case "file exists":
+		err = fs.ErrExist
+	case "permission denied", "operation not permitted":
+		err = fs.ErrPermission
+	default:
+		err = errors.New(msg)
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (fsys *GuestFS) Open(name string) (fs.File, error) {
+	var e guestEntry
+	resp, err := fsys.call("open", name, "ReadStream", guestPath(name), &e)
+	if err != nil {
+		return nil, err
+	}
+	info := &guestFileInfo{e}
+	if e.IsDir {
+		// nothing is streamed for directories
+		resp.Channel.Close()
+		return &guestDir{fsys: fsys, name: name, info: info}, nil
+	}
+	return &guestFile{fsys: fsys, name: name, info: info, resp: resp}, nil
+}
+
+// OpenFile opens a file for reading if flag is read-only, otherwise for
+// writing. Files can't be opened for both.
+func (fsys *GuestFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fsys.Open(name)
+	}
+	in := guestWriteInput{
+		Path:      guestPath(name),
+		Append:    flag&os.O_APPEND != 0,
+		Create:    flag&os.O_CREATE != 0,
+		Exclusive: flag&os.O_EXCL != 0,
+		Truncate:  flag&os.O_TRUNC != 0,
+		Perm:      uint32(perm),
+	}
+	resp, err := fsys.call("open", name, "WriteStream", in, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &guestFile{fsys: fsys, name: name, resp: resp, writable: true}, nil
+}
+
+func (fsys *GuestFS) Create(name string) (fs.File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Stat describes a file, following symbolic links
+func (fsys *GuestFS) Stat(name string) (fs.FileInfo, error) {
+	var e guestEntry
+	if _, err := fsys.call("stat", name, "Stat", fn.Args{guestPath(name)}, &e); err != nil {
+		return nil, err
+	}
+	return &guestFileInfo{e}, nil
+}
+
+// Lstat describes a file without following symbolic links
+func (fsys *GuestFS) Lstat(name string) (fs.FileInfo, error) {
+	var e guestEntry
+	if _, err := fsys.call("lstat", name, "Lstat", fn.Args{guestPath(name)}, &e); err != nil {
+		return nil, err
+	}
+	return &guestFileInfo{e}, nil
+}
+
+// ReadDir returns the entries of a directory sorted by name. Symbolic links
+// are not followed.
+func (fsys *GuestFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var entries []guestEntry
+	if _, err := fsys.call("readdir", name, "ReadDir", fn.Args{guestPath(name)}, &entries); err != nil {
+		return nil, err
+	}
+	dir := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		dir[i] = fs.FileInfoToDirEntry(&guestFileInfo{e})
+	}
+	return dir, nil
+}
+
+func (fsys *GuestFS) Readlink(name string) (string, error) {
+	var target string
+	_, err := fsys.call("readlink", name, "Readlink", fn.Args{guestPath(name)}, &target)
+	return target, err
+}
+
+// Symlink creates name as a symbolic link to target, which is used as is
+// in the guest
+func (fsys *GuestFS) Symlink(target, name string) error {
+	_, err := fsys.call("symlink", name, "Symlink", fn.Args{target, guestPath(name)}, nil)
+	return err
+}
+
+func (fsys *GuestFS) Chmod(name string, mode fs.FileMode) error {
+	_, err := fsys.call("chmod", name, "Chmod", fn.Args{guestPath(name), uint32(mode)}, nil)
+	return err
+}
+
+func (fsys *GuestFS) Chown(name string, uid, gid int) error {
+	_, err := fsys.call("chown", name, "Chown", fn.Args{guestPath(name), uid, gid}, nil)
+	return err
+}
+
+// Lchown is like Chown but changes a symbolic link instead of its target
+func (fsys *GuestFS) Lchown(name string, uid, gid int) error {
+	_, err := fsys.call("lchown", name, "Lchown", fn.Args{guestPath(name), uid, gid}, nil)
+	return err
+}
+
+func (fsys *GuestFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	_, err := fsys.call("chtimes", name, "Chtimes", fn.Args{guestPath(name), atime.UnixNano(), mtime.UnixNano()}, nil)
+	return err
+}
+
+func (fsys *GuestFS) Mkdir(name string, perm fs.FileMode) error {
+	_, err := fsys.call("mkdir", name, "Mkdir", fn.Args{guestPath(name), uint32(perm)}, nil)
+	return err
+}
+
+func (fsys *GuestFS) MkdirAll(name string, perm fs.FileMode) error {
+	_, err := fsys.call("mkdir", name, "MkdirAll", fn.Args{guestPath(name), uint32(perm)}, nil)
+	return err
+}
+
+func (fsys *GuestFS) Remove(name string) error {
+	_, err := fsys.call("remove", name, "Remove", fn.Args{guestPath(name)}, nil)
+	return err
+}
+
+func (fsys *GuestFS) RemoveAll(name string) error {
+	_, err := fsys.call("removeall", name, "RemoveAll", fn.Args{guestPath(name)}, nil)
+	return err
+}
+
+func (fsys *GuestFS) Rename(oldname, newname string) error {
+	if !fs.ValidPath(newname) {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+	_, err := fsys.call("rename", oldname, "Rename", fn.Args{guestPath(oldname), guestPath(newname)}, nil)
+	return err
+}
+
+type guestExtractInput struct {
+	Dir  string
+	Name string
+}
+
+// Archive streams a tar archive of a path in the guest, with entries named
+// from the base name of the path. It also returns the total size of the
+// regular files in the archive, such as for showing progress.
+func (g *Guest) Archive(path string) (io.ReadCloser, int64, error) {
+	return g.ArchiveContext(context.Background(), path)
+}
+
+// ArchiveContext is like Archive but the stream is closed if ctx is done.
+func (g *Guest) ArchiveContext(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	var size int64
+	resp, err := g.peer.Call(ctx, "vm.Archive", path, &size)
+	if err != nil {
+		return nil, 0, err
+	}
+	context.AfterFunc(ctx, func() {
+		resp.Channel.Close()
+	})
+	return &guestFile{name: path, resp: resp}, size, nil
+}
+
+// Extract extracts a tar archive into a directory in the guest, keeping
+// permissions, symbolic links and mtimes. If name isn't empty, it replaces
+// the top level name of the entries, so an archive of foo can be extracted
+// as dir/bar.
+func (g *Guest) Extract(r io.Reader, dir, name string) error {
+	return g.ExtractContext(context.Background(), r, dir, name)
+}
+
+// ExtractContext is like Extract but gives up if ctx is done.
+func (g *Guest) ExtractContext(ctx context.Context, r io.Reader, dir, name string) error {
+	resp, err := g.peer.Call(ctx, "vm.Extract", guestExtractInput{Dir: dir, Name: name}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Channel.Close()
+	stop := context.AfterFunc(ctx, func() {
+		resp.Channel.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, guestChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := resp.Send(guestFileChunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			resp.Send(guestFileChunk{Err: err.Error()})
+			return err
+		}
+	}
+	if err := resp.Send(guestFileChunk{EOF: true}); err != nil {
+		return err
+	}
+	var result guestFileChunk
+	if err := resp.Receive(&result); err != nil {
+		return err
+	}
+	if result.Err != "" {
+		return errors.New(result.Err)
+	}
+	return nil
+}
+
+type guestFileInfo struct {
+	e guestEntry
+}
+
+func (fi *guestFileInfo) Name() string {
+	return fi.e.Name
+}
+
+func (fi *guestFileInfo) Size() int64 {
+	return int64(fi.e.Size)
+}
+
+func (fi *guestFileInfo) Mode() fs.FileMode {
+	if fi.e.Mode == 0 && fi.e.IsDir {
+		// from a guest service that doesn't report modes
+		return fs.ModeDir | 0755
+	}
+	return fs.FileMode(fi.e.Mode)
+}
+
+func (fi *guestFileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.e.Mtime), 0)
+}
+
+func (fi *guestFileInfo) IsDir() bool {
+	return fi.e.IsDir
+}
+
+func (fi *guestFileInfo) Sys() any {
+	return &GuestStat{UID: fi.e.UID, GID: fi.e.GID, Link: fi.e.Link}
+}
+
+// guestFile is a file streamed from or to the guest, or an archive from
+// Archive. Writes are only acknowledged by the guest on Close, which returns
+// any error writing.
+type guestFile struct {
+	fsys     *GuestFS
+	name     string
+	info     fs.FileInfo
+	resp     *rpc.Response
+	writable bool
+
+	mu     sync.Mutex
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func (f *guestFile) Stat() (fs.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+	return f.fsys.Stat(f.name)
+}
+
+func (f *guestFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.writable {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("file opened for writing")}
+	}
+	for len(f.buf) == 0 && f.err == nil {
+		var chunk guestFileChunk
+		if err := f.resp.Receive(&chunk); err != nil {
+			f.err = err
+			break
+		}
+		f.buf = chunk.Data
+		switch {
+		case chunk.Err != "":
+			f.err = &fs.PathError{Op: "read", Path: f.name, Err: errors.New(chunk.Err)}
+		case chunk.EOF:
+			f.err = io.EOF
+		}
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, f.err
+}
+
+func (f *guestFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errors.New("file opened for reading")}
+	}
+	var n int
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+guestChunkSize)]
+		if err := f.resp.Send(guestFileChunk{Data: chunk}); err != nil {
+			return n, &fs.PathError{Op: "write", Path: f.name, Err: err}
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+func (f *guestFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	defer f.resp.Channel.Close()
+	if !f.writable {
+		return nil
+	}
+	if err := f.resp.Send(guestFileChunk{EOF: true}); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	var result guestFileChunk
+	if err := f.resp.Receive(&result); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	if result.Err != "" {
+		return guestPathError("write", f.name, errors.New(result.Err))
+	}
+	return nil
+}
+
+// guestDir is an open directory, which reads its entries on first use
+type guestDir struct {
+	fsys    *GuestFS
+	name    string
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *guestDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *guestDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *guestDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *guestDir) Close() error {
+	return nil
+}
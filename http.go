@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 
 	"github.com/progrium/env86/assets"
 	"github.com/progrium/env86/network"
@@ -25,8 +28,14 @@ func (vm *VM) startHTTP() {
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/net", network.Handler(vm.net))
+	opts := vm.networkOptions()
+	if vm.netPipe != nil {
+		mux.Handle("/net", network.PipeHandler(vm.netPipe, opts))
+	} else {
+		mux.Handle("/net", network.Handler(vm.net, opts))
+	}
 	mux.Handle("/guest", websocket.Handler(vm.handleGuest))
+	mux.Handle("/guest/proxy", websocket.Server{Handshake: localOnly, Handler: vm.handleGuestProxy})
 	mux.Handle("/ctl", websocket.Handler(vm.handleControl))
 	mux.Handle("/env86.min.js", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("content-type", "text/javascript")
@@ -43,26 +52,64 @@ func (vm *VM) startHTTP() {
 	}
 }
 
+// localOnly refuses websocket connections from other hosts and from web
+// pages, which could otherwise reach into a VM running on this host
+func localOnly(config *websocket.Config, req *http.Request) error {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return err
+	}
+	if ip, err := netip.ParseAddr(host); err != nil || !ip.IsLoopback() {
+		return fmt.Errorf("connection from %s is not local", host)
+	}
+	// a page on another site can point its own name at this host, but
+	// then the Host header is that name
+	if !loopbackHost(req.Host) {
+		return fmt.Errorf("connection to %s is not local", req.Host)
+	}
+	origin, err := websocket.Origin(config, req)
+	if err != nil || origin == nil || origin.Host != req.Host {
+		return fmt.Errorf("connection from origin %q is not allowed", req.Header.Get("Origin"))
+	}
+	config.Origin = origin
+	return nil
+}
+
+// loopbackHost reports whether the host of a Host header is localhost or
+// a loopback IP
+func loopbackHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
 func (vm *VM) handleControl(conn *websocket.Conn) {
 	conn.PayloadType = websocket.BinaryFrame
 	sess := mux.New(conn)
 	defer sess.Close()
 
-	vm.peer = talk.NewPeer(sess, codec.CBORCodec{})
-	vm.peer.Handle("loaded", fn.HandlerFrom(func() {
+	peer := talk.NewPeer(sess, codec.CBORCodec{})
+	peer.Handle("loaded", fn.HandlerFrom(func() {
 		if vm.loaded != nil {
 			vm.loaded <- true
 		}
 	}))
-	vm.peer.Handle("log", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+	peer.Handle("log", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
 		var args []any
 		c.Receive(&args)
 		log.Println(args...)
 	}))
-	vm.peer.Handle("config", fn.HandlerFrom(func() Config {
+	peer.Handle("config", fn.HandlerFrom(func() Config {
 		return vm.config
 	}))
-	vm.peer.Handle("tty", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
+	peer.Handle("tty", rpc.HandlerFunc(func(r rpc.Responder, c *rpc.Call) {
 		c.Receive(nil)
 		if !vm.config.EnableTTY {
 			r.Return(fmt.Errorf("tty is not enabled"))
@@ -76,9 +123,16 @@ func (vm *VM) handleControl(conn *websocket.Conn) {
 		vm.handleTTY(ch)
 	}))
 
-	vm.peer.Respond()
+	vm.peer.Store(peer)
+	peer.Respond()
 
+	if !vm.peer.CompareAndSwap(peer, nil) {
+		// stopped or replaced by a restart
+		return
+	}
 	// websocket closed, so we assume window was closed
-	vm.win = nil
-	vm.Stop()
+	vm.mu.Lock()
+	vm.host = nil
+	vm.mu.Unlock()
+	vm.stop(ExitWindowClosed, nil)
 }
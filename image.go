@@ -10,6 +10,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/progrium/env86/assets"
 	"github.com/progrium/env86/fsutil"
@@ -23,8 +25,14 @@ import (
 
 type Image struct {
 	FS fs.FS
+
+	// archive is the path of the tarball the image was loaded from,
+	// which is rewritten when the image is saved
+	archive string
 }
 
+// LoadImageReader loads an image from a gzipped tarball. Changes to the
+// image are kept in memory.
 func LoadImageReader(r io.Reader) (*Image, error) {
 	imageUnzipped, err := gzip.NewReader(r)
 	if err != nil {
@@ -55,7 +63,12 @@ func LoadImage(path string) (*Image, error) {
 		return nil, err
 	}
 	defer imageFile.Close()
-	return LoadImageReader(imageFile)
+	image, err := LoadImageReader(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	image.archive = imagePath
+	return image, nil
 }
 
 func (i *Image) Config() (Config, error) {
@@ -67,12 +80,31 @@ func (i *Image) Config() (Config, error) {
 	if err != nil {
 		return Config{}, err
 	}
+	netconf, err := i.networkConfig()
+	if err != nil {
+		return Config{}, err
+	}
 	return Config{
 		V86Config: v86conf,
 		ColdBoot:  coldboot,
+		Network:   netconf,
 	}, nil
 }
 
+func (i *Image) networkConfig() (NetworkConfig, error) {
+	b, err := fs.ReadFile(i.FS, "image.json")
+	if err != nil {
+		return NetworkConfig{}, err
+	}
+	var conf struct {
+		Network NetworkConfig `json:"network"`
+	}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return NetworkConfig{}, err
+	}
+	return conf.Network, nil
+}
+
 func (i *Image) v86Config() (V86Config, error) {
 	b, err := fs.ReadFile(i.FS, "image.json")
 	if err != nil {
@@ -85,6 +117,98 @@ func (i *Image) v86Config() (V86Config, error) {
 	return v86conf, nil
 }
 
+// SetMemorySize records the memory and VGA memory sizes in image.json,
+// leaving the rest of it as it is. A size of zero is left unchanged.
+// Tarball images get the change the next time they're written back, like
+// when a state is saved to them, rather than being rewritten for it.
+func (i *Image) SetMemorySize(memory, vgaMemory int) error {
+	b, err := fs.ReadFile(i.FS, "image.json")
+	if err != nil {
+		return err
+	}
+	var conf V86Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+	var names []string
+	var values []any
+	if memory != 0 && memory != conf.MemorySize {
+		names = append(names, "memory_size")
+		values = append(values, memory)
+	}
+	if vgaMemory != 0 && vgaMemory != conf.VGAMemorySize {
+		names = append(names, "vga_memory_size")
+		values = append(values, vgaMemory)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	b, err = setJSONFields(b, names, values)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(i.FS, "image.json", b, 0644)
+}
+
+// setJSONFields sets fields of a JSON object, keeping the others and their
+// order. Fields it doesn't have yet are added at the end.
+func setJSONFields(b []byte, names []string, values []any) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	var order []string
+	fields := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := tok.(string)
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		if _, ok := fields[name]; !ok {
+			order = append(order, name)
+		}
+		fields[name] = v
+	}
+	for n, name := range names {
+		v, err := json.Marshal(values[n])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fields[name]; !ok {
+			order = append(order, name)
+		}
+		fields[name] = v
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for n, name := range order {
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(fields[name])
+	}
+	buf.WriteByte('}')
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
 func (i *Image) HasInitialState() bool {
 	b, _ := fs.Exists(i.FS, "initial.state")
 	return b || i.hasCompressedInitialState()
@@ -114,30 +238,260 @@ func (i *Image) InitialStateConfig() *ImageConfig {
 	}
 }
 
+// StateFormat is how a saved state is stored in an image
+type StateFormat string
+
+const (
+	// StateFormatDefault saves states zstd compressed, since they're
+	// large and v86 reads them either way
+	StateFormatDefault StateFormat = ""
+	StateFormatRaw     StateFormat = "raw"
+	StateFormatZstd    StateFormat = "zstd"
+)
+
+func ParseStateFormat(s string) (StateFormat, error) {
+	switch StateFormat(s) {
+	case StateFormatDefault, StateFormatRaw, StateFormatZstd:
+		return StateFormat(s), nil
+	default:
+		return "", fmt.Errorf("unknown state format: %s", s)
+	}
+}
+
+// InitialStateFormat returns the format of the initial state, or an empty
+// format if there is no initial state
+func (i *Image) InitialStateFormat() StateFormat {
+	if !i.HasInitialState() {
+		return ""
+	}
+	if i.hasCompressedInitialState() {
+		return StateFormatZstd
+	}
+	return StateFormatRaw
+}
+
+// OpenInitialState returns a reader of the uncompressed initial state
+func (i *Image) OpenInitialState() (io.ReadCloser, error) {
+	return openState(i.FS, "initial.state")
+}
+
 func (i *Image) SaveInitialState(r io.Reader) error {
-	// TODO: write new tgz if loaded from tgz
+	return i.SaveInitialStateFormat(r, StateFormatDefault)
+}
+
+// SaveInitialStateFormat writes r as the initial state in the given format,
+// replacing an initial state in the other format
+func (i *Image) SaveInitialStateFormat(r io.Reader, format StateFormat) error {
+	if err := writeState(i.FS, "initial.state", r, format); err != nil {
+		return err
+	}
+	return i.commit()
+}
+
+// ConvertState rewrites the initial state and all snapshots in the given format
+func (i *Image) ConvertState(format StateFormat) error {
+	if format == StateFormatDefault {
+		return fmt.Errorf("state format must be %s or %s", StateFormatRaw, StateFormatZstd)
+	}
+	names := []string{}
+	if i.HasInitialState() {
+		names = append(names, "initial.state")
+	}
+	snapshots, err := i.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		names = append(names, snapshotPath(snap.Name, "state"))
+	}
+	for _, name := range names {
+		r, err := openState(i.FS, name)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if err := writeState(i.FS, name, bytes.NewReader(b), format); err != nil {
+			return err
+		}
+	}
+	return i.commit()
+}
 
-	shouldCompress := i.hasCompressedInitialState() // || !i.HasInitialState()
-	if shouldCompress {
-		var buf bytes.Buffer
-		// BUG: this implementation doesn't seem to be compatible with v86's decompressor!
-		enc, err := zstd.NewWriter(&buf)
+// commit writes the image back to the tarball it was loaded from. The new
+// tarball is written next to the original and renamed over it, so the
+// original is left intact if anything fails.
+func (i *Image) commit() error {
+	if i.archive == "" {
+		return nil
+	}
+	fi, err := os.Stat(i.archive)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(i.archive), "."+filepath.Base(i.archive)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := i.WriteArchive(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), i.archive)
+}
+
+// WriteArchive writes the image as a gzipped tarball in the layout expected
+// by LoadImageReader and pull. The output is deterministic: entries are
+// sorted by path, and modification times and ownership are cleared, so the
+// same image always produces the same bytes. Only directories and regular
+// files can be archived.
+func (i *Image) WriteArchive(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	if err := writeTar(tw, i.FS, "."); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeTar(tw *tar.Writer, fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Name() < entries[b].Name()
+	})
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: time.Unix(0, 0),
+		}
+		switch {
+		case fi.IsDir():
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+		case fi.Mode().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+		default:
+			return fmt.Errorf("cannot archive %s: unsupported file type %v", name, fi.Mode().Type())
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err := writeTar(tw, fsys, name); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := fsys.Open(name)
 		if err != nil {
 			return err
 		}
-		defer enc.Close()
-		_, err = io.Copy(enc, r)
+		_, err = io.Copy(tw, f)
+		f.Close()
 		if err != nil {
 			return err
 		}
-		return fs.WriteFile(i.FS, "initial.state.zst", buf.Bytes(), 0644)
 	}
+	return nil
+}
 
+// writeState writes a state file as name.zst, or as name if format is raw,
+// and removes the file of the other format if there is one.
+func writeState(fsys fs.FS, name string, r io.Reader, format StateFormat) error {
 	b, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	return fs.WriteFile(i.FS, "initial.state", b, 0644)
+	filename, stale := name, name+".zst"
+	if format != StateFormatRaw {
+		b, err = compressState(b)
+		if err != nil {
+			return err
+		}
+		filename, stale = stale, filename
+	}
+	if err := fs.WriteFile(fsys, filename, b, 0644); err != nil {
+		return err
+	}
+	if ok, _ := fs.Exists(fsys, stale); ok {
+		rfs, ok := fsys.(interface {
+			Remove(name string) error
+		})
+		if !ok {
+			return fs.ErrPermission
+		}
+		return rfs.Remove(stale)
+	}
+	return nil
+}
+
+// openState opens name or name.zst, decompressing the latter
+func openState(fsys fs.FS, name string) (io.ReadCloser, error) {
+	if ok, _ := fs.Exists(fsys, name+".zst"); ok {
+		f, err := fsys.Open(name + ".zst")
+		if err != nil {
+			return nil, err
+		}
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &zstdReadCloser{Decoder: dec, f: f}, nil
+	}
+	return fsys.Open(name)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	f fs.File
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return z.f.Close()
+}
+
+// compressState compresses a state so v86 can decompress it. v86 sizes its
+// output buffer from the content size in the frame header, which the
+// streaming encoder leaves out, so the whole state is encoded as one
+// single segment frame without the optional checksum.
+func compressState(b []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithSingleSegment(true),
+		zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(b, nil), nil
 }
 
 func (i *Image) Prepare() (fs.FS, error) {
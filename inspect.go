@@ -0,0 +1,292 @@
+package env86
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"tractor.dev/toolkit-go/engine/fs"
+)
+
+// ImageReport describes the contents of an image and any problems
+// found in it. It's produced by Image.Inspect.
+type ImageReport struct {
+	Config       V86Config          `json:"config"`
+	InitialState *StateReport       `json:"initial_state,omitempty"`
+	Snapshots    []string           `json:"snapshots,omitempty"`
+	Filesystem   *FilesystemReport  `json:"filesystem,omitempty"`
+	Kernel       string             `json:"kernel,omitempty"`
+	Initrd       string             `json:"initrd,omitempty"`
+	GuestService GuestServiceReport `json:"guest_service"`
+	Problems     []string           `json:"problems,omitempty"`
+}
+
+// StateReport describes a saved state file. UncompressedSize is only
+// known for compressed states that record it in the frame header.
+// MemorySize is the memory size the state was saved with.
+type StateReport struct {
+	File             string      `json:"file"`
+	Format           StateFormat `json:"format"`
+	Size             int64       `json:"size"`
+	UncompressedSize int64       `json:"uncompressed_size,omitempty"`
+	MemorySize       int         `json:"memory_size,omitempty"`
+}
+
+// FilesystemReport summarizes fs.json and the blobs under fs/
+type FilesystemReport struct {
+	Version      int   `json:"version"`
+	Files        int   `json:"files"`
+	Dirs         int   `json:"dirs"`
+	Symlinks     int   `json:"symlinks"`
+	TotalSize    int64 `json:"total_size"`
+	Blobs        int   `json:"blobs"`
+	MissingBlobs int   `json:"missing_blobs"`
+	UnusedBlobs  int   `json:"unused_blobs"`
+}
+
+// GuestServiceReport compares has_guest_service in image.json with
+// whether bin/guest86 is in the filesystem
+type GuestServiceReport struct {
+	Enabled bool `json:"has_guest_service"`
+	Present bool `json:"present"`
+}
+
+const (
+	fsIndexName = 0
+	fsIndexSize = 1
+	fsIndexMode = 3
+	fsIndexData = 6
+
+	fsModeType = 0xF000
+	fsModeLink = 0xA000
+	fsModeDir  = 0x4000
+)
+
+// Inspect examines the image without modifying it. Problems that make
+// parts of the image unreadable are reported rather than returned, so
+// an error means the image has no usable image.json.
+func (i *Image) Inspect() (*ImageReport, error) {
+	conf, err := i.v86Config()
+	if err != nil {
+		return nil, fmt.Errorf("reading image.json: %w", err)
+	}
+	r := &ImageReport{Config: conf}
+	r.GuestService.Enabled = conf.HasGuestService
+
+	raw, _ := fs.Exists(i.FS, "initial.state")
+	if raw && i.hasCompressedInitialState() {
+		r.problem("both initial.state and initial.state.zst exist, initial.state.zst is used")
+	}
+	if i.HasInitialState() {
+		name := "initial.state"
+		if i.hasCompressedInitialState() {
+			name += ".zst"
+		}
+		r.InitialState, err = i.inspectState(name)
+		if err != nil {
+			r.problem(err.Error())
+		} else if r.InitialState.Format == StateFormatZstd && r.InitialState.UncompressedSize == 0 {
+			r.problem("initial.state.zst has no content size and can't be loaded by v86, rewrite it with convert")
+		}
+		memory := conf.MemorySize
+		if memory == 0 {
+			memory = DefaultMemorySize
+		}
+		if r.InitialState != nil && r.InitialState.MemorySize != 0 && r.InitialState.MemorySize != memory {
+			r.problem((&MemorySizeError{State: r.InitialState.MemorySize, Config: memory}).Error())
+		}
+	}
+	if conf.InitialStateParts > 0 {
+		r.problem("initial_state_parts is set, which is only used by prepared images")
+	}
+
+	snapshots, err := i.Snapshots()
+	if err != nil {
+		r.problem(fmt.Sprintf("reading snapshots: %s", err))
+	}
+	for _, snap := range snapshots {
+		r.Snapshots = append(r.Snapshots, snap.Name)
+	}
+
+	if ok, _ := fs.Exists(i.FS, "fs.json"); ok {
+		i.inspectFilesystem(r)
+	} else if conf.Filesystem != nil {
+		r.problem("image.json configures a filesystem but fs.json is missing")
+	} else if conf.HDA == nil && conf.FDA == nil && conf.CDROM == nil && conf.BZImage == nil {
+		r.problem("image has no fs.json and no disk or kernel to boot from")
+	}
+
+	if conf.HasGuestService && !r.GuestService.Present {
+		r.problem("has_guest_service is set but bin/guest86 is not in the filesystem")
+	}
+	if !conf.HasGuestService && r.GuestService.Present {
+		r.problem("bin/guest86 is in the filesystem but has_guest_service is not set")
+	}
+	if conf.BZImageInitrdFromFilesystem {
+		if r.Kernel == "" {
+			r.problem("bzimage_initrd_from_filesystem is set but no kernel was found")
+		}
+		if r.Initrd == "" {
+			r.problem("bzimage_initrd_from_filesystem is set but no initrd was found")
+		}
+	}
+	return r, nil
+}
+
+func (r *ImageReport) problem(s string) {
+	r.Problems = append(r.Problems, s)
+}
+
+func (i *Image) inspectState(name string) (*StateReport, error) {
+	fi, err := fs.Stat(i.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	s := &StateReport{
+		File:   name,
+		Format: StateFormatRaw,
+		Size:   fi.Size(),
+	}
+	state, err := openState(i.FS, strings.TrimSuffix(name, ".zst"))
+	if err != nil {
+		return nil, err
+	}
+	s.MemorySize, err = stateMemorySize(state)
+	state.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if !strings.HasSuffix(name, ".zst") {
+		return s, nil
+	}
+	s.Format = StateFormatZstd
+	f, err := i.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, zstd.HeaderMaxSize)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	var h zstd.Header
+	if err := h.Decode(b[:n]); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if h.HasFCS {
+		s.UncompressedSize = int64(h.FrameContentSize)
+	}
+	return s, nil
+}
+
+func (i *Image) inspectFilesystem(r *ImageReport) {
+	b, err := fs.ReadFile(i.FS, "fs.json")
+	if err != nil {
+		r.problem(fmt.Sprintf("reading fs.json: %s", err))
+		return
+	}
+	var index struct {
+		Version int   `json:"version"`
+		Size    int64 `json:"size"`
+		Root    []any `json:"fsroot"`
+	}
+	if err := json.Unmarshal(b, &index); err != nil {
+		r.problem(fmt.Sprintf("parsing fs.json: %s", err))
+		return
+	}
+
+	blobs := map[string]bool{}
+	if ok, _ := fs.DirExists(i.FS, "fs"); ok {
+		entries, err := fs.ReadDir(i.FS, "fs")
+		if err != nil {
+			r.problem(fmt.Sprintf("reading fs: %s", err))
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				blobs[e.Name()] = false
+			}
+		}
+	}
+
+	rep := &FilesystemReport{
+		Version: index.Version,
+		Blobs:   len(blobs),
+	}
+	r.Filesystem = rep
+	walkFSIndex(index.Root, "", func(name string, size int64, mode int64, data any) {
+		rep.TotalSize += size
+		switch mode & fsModeType {
+		case fsModeDir:
+			rep.Dirs++
+			return
+		case fsModeLink:
+			rep.Symlinks++
+		default:
+			rep.Files++
+			blob, _ := data.(string)
+			_, ok := blobs[blob]
+			if ok {
+				blobs[blob] = true
+			} else {
+				rep.MissingBlobs++
+			}
+			if name == "bin/guest86" {
+				r.GuestService.Present = ok
+			}
+		}
+
+		dir, base := path.Split(name)
+		if dir != "" && dir != "boot/" {
+			return
+		}
+		lower := strings.ToLower(base)
+		if r.Kernel == "" && (strings.HasPrefix(lower, "vmlinuz") || strings.HasPrefix(lower, "bzimage")) {
+			r.Kernel = name
+		}
+		if r.Initrd == "" && (strings.HasPrefix(lower, "initrd") || strings.HasPrefix(lower, "initramfs")) {
+			r.Initrd = name
+		}
+	})
+	for _, used := range blobs {
+		if !used {
+			rep.UnusedBlobs++
+		}
+	}
+
+	if index.Version != 3 {
+		r.problem(fmt.Sprintf("fs.json has version %d, expected 3", index.Version))
+	}
+	if rep.MissingBlobs > 0 {
+		r.problem(fmt.Sprintf("%d files in fs.json have no blob under fs/", rep.MissingBlobs))
+	}
+	if rep.UnusedBlobs > 0 {
+		r.problem(fmt.Sprintf("%d blobs under fs/ are not used by fs.json", rep.UnusedBlobs))
+	}
+	if index.Size != rep.TotalSize {
+		r.problem(fmt.Sprintf("fs.json size is %d but its entries add up to %d", index.Size, rep.TotalSize))
+	}
+}
+
+// walkFSIndex calls fn for every entry of a v86 fs.json tree. Each entry is
+// an array of name, size, mtime, mode, uid, gid and then the children of a
+// directory, the target of a symlink or the blob name of a file.
+func walkFSIndex(entries []any, dir string, fn func(name string, size int64, mode int64, data any)) {
+	for _, e := range entries {
+		fields, ok := e.([]any)
+		if !ok || len(fields) <= fsIndexData {
+			continue
+		}
+		name, _ := fields[fsIndexName].(string)
+		size, _ := fields[fsIndexSize].(float64)
+		mode, _ := fields[fsIndexMode].(float64)
+		name = path.Join(dir, name)
+		fn(name, int64(size), int64(mode), fields[fsIndexData])
+		if children, ok := fields[fsIndexData].([]any); ok && int64(mode)&fsModeType == fsModeDir {
+			walkFSIndex(children, name, fn)
+		}
+	}
+}
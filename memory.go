@@ -0,0 +1,147 @@
+package env86
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	DefaultMemorySize    = 512 * 1024 * 1024 // 512MB
+	DefaultVGAMemorySize = 8 * 1024 * 1024   // 8MB
+)
+
+// ParseSize parses a size in bytes with an optional K, M or G suffix,
+// which may be followed by B or iB. All suffixes are powers of 1024.
+func ParseSize(s string) (int, error) {
+	num := strings.TrimSpace(strings.ToUpper(s))
+	num = strings.TrimSuffix(strings.TrimSuffix(num, "IB"), "B")
+	mult := 1
+	switch {
+	case strings.HasSuffix(num, "K"):
+		mult = 1024
+	case strings.HasSuffix(num, "M"):
+		mult = 1024 * 1024
+	case strings.HasSuffix(num, "G"):
+		mult = 1024 * 1024 * 1024
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * mult, nil
+}
+
+// FormatSize formats a size in bytes using the largest unit that
+// divides it evenly
+func FormatSize(n int) string {
+	switch {
+	case n == 0:
+		return "0B"
+	case n%(1024*1024*1024) == 0:
+		return fmt.Sprintf("%dGB", n/(1024*1024*1024))
+	case n%(1024*1024) == 0:
+		return fmt.Sprintf("%dMB", n/(1024*1024))
+	case n%1024 == 0:
+		return fmt.Sprintf("%dKB", n/1024)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+// MemorySizeError is returned when a state was saved with a different
+// memory size than the VM is configured with. v86 can't restore such a
+// state, so it's refused before the emulator sees it.
+type MemorySizeError struct {
+	State  int
+	Config int
+}
+
+func (e *MemorySizeError) Error() string {
+	return fmt.Sprintf("state was saved with %s of memory but the VM is configured with %s",
+		FormatSize(e.State), FormatSize(e.Config))
+}
+
+func checkStateMemory(state io.Reader, memorySize int) error {
+	n, err := stateMemorySize(state)
+	if err != nil {
+		return err
+	}
+	if n != 0 && n != memorySize {
+		return &MemorySizeError{State: n, Config: memorySize}
+	}
+	return nil
+}
+
+const (
+	v86StateMagic = 0x86768676
+	zstdMagic     = 0xFD2FB528
+
+	// v86 states start with a header of the magic, version, total
+	// length and length of the JSON info block that follows
+	v86StateHeaderSize = 16
+
+	// maxStateInfoSize is far more than the info block of any state needs,
+	// so a corrupt header can't make it allocate gigabytes
+	maxStateInfoSize = 16 * 1024 * 1024
+)
+
+// stateMemorySize reads the memory size a v86 state was saved with from
+// the info block of the state, which may be zstd compressed. The size is
+// the first field of the saved CPU state. It returns 0 if the state isn't
+// in a format it recognizes.
+func stateMemorySize(r io.Reader) (int, error) {
+	header := make([]byte, v86StateHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// too short to be a state
+			return 0, nil
+		}
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(header) == zstdMagic {
+		dec, err := zstd.NewReader(io.MultiReader(bytes.NewReader(header), r))
+		if err != nil {
+			return 0, err
+		}
+		defer dec.Close()
+		return stateMemorySize(dec)
+	}
+	if binary.LittleEndian.Uint32(header) != v86StateMagic {
+		return 0, nil
+	}
+	total := binary.LittleEndian.Uint32(header[8:])
+	n := binary.LittleEndian.Uint32(header[12:])
+	if n > maxStateInfoSize || n > total-min(total, v86StateHeaderSize) {
+		return 0, fmt.Errorf("state has an invalid info block length of %d bytes", n)
+	}
+	// read rather than allocate up front, so a length past the end of the
+	// state only takes as much memory as the state has
+	info, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	if len(info) < int(n) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	var block struct {
+		State []json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal(info, &block); err != nil || len(block.State) == 0 {
+		return 0, nil
+	}
+	var size int
+	if err := json.Unmarshal(block.State[0], &size); err != nil {
+		return 0, nil
+	}
+	return size, nil
+}
@@ -0,0 +1,101 @@
+package env86
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		err  bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "64K", want: 64 * 1024},
+		{in: "512M", want: 512 * 1024 * 1024},
+		{in: "512MB", want: 512 * 1024 * 1024},
+		{in: "512MiB", want: 512 * 1024 * 1024},
+		{in: "2g", want: 2 * 1024 * 1024 * 1024},
+		{in: " 8mb ", want: 8 * 1024 * 1024},
+		{in: "100B", want: 100},
+		{in: "", err: true},
+		{in: "M", err: true},
+		{in: "0", err: true},
+		{in: "-1M", err: true},
+		{in: "1.5G", err: true},
+		{in: "12T", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// testState returns a v86 state header and info block with the given JSON
+func testState(info string) []byte {
+	b := make([]byte, v86StateHeaderSize)
+	binary.LittleEndian.PutUint32(b, v86StateMagic)
+	binary.LittleEndian.PutUint32(b[4:], 6)
+	binary.LittleEndian.PutUint32(b[8:], uint32(v86StateHeaderSize+len(info)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(info)))
+	return append(b, info...)
+}
+
+// badLength returns a copy of a state with a length in its header changed
+func badLength(state []byte, offset int, n uint32) []byte {
+	b := bytes.Clone(state)
+	binary.LittleEndian.PutUint32(b[offset:], n)
+	return b
+}
+
+func TestStateMemorySize(t *testing.T) {
+	state := testState(`{"state":[134217728,1,2]}`)
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := enc.EncodeAll(state, nil)
+	enc.Close()
+
+	tests := []struct {
+		name  string
+		state []byte
+		want  int
+		err   bool
+	}{
+		{name: "state", state: state, want: 128 * 1024 * 1024},
+		{name: "compressed", state: compressed, want: 128 * 1024 * 1024},
+		{name: "empty", state: nil},
+		{name: "short", state: state[:10]},
+		{name: "other format", state: bytes.Repeat([]byte{1}, 32)},
+		{name: "no cpu state", state: testState(`{"buffer_infos":[]}`)},
+		{name: "bad info", state: testState(`{"state":`)},
+		{name: "truncated info", state: state[:v86StateHeaderSize+4], err: true},
+		{name: "info past total length", state: badLength(state, 8, v86StateHeaderSize+4), err: true},
+		{name: "huge info", state: badLength(state, 12, 1<<32-1), err: true},
+	}
+	for _, tt := range tests {
+		got, err := stateMemorySize(bytes.NewReader(tt.state))
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: got %d, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+	}
+}
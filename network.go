@@ -0,0 +1,260 @@
+package env86
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/progrium/env86/network"
+
+	"github.com/progrium/go-netstack/vnet"
+)
+
+const (
+	DefaultSubnet     = "192.168.127.0/24"
+	DefaultGatewayMAC = "5a:94:ef:e4:0c:dd"
+	DefaultMTU        = 1500
+
+	// HostAlias is a name guests can resolve to HostIP when it's set
+	HostAlias = "host.env86.internal"
+
+	// AutoHostIP as HostIP uses the first virtual IP
+	AutoHostIP = "auto"
+)
+
+// NetworkConfig is the topology of the virtual network. Empty fields are
+// derived from the subnet: the gateway is its first address, the virtual
+// IP is the one below the last usable address, and the guest IP is the
+// first address the DHCP server hands out. The gateway also serves DNS and
+// DHCP to the guest.
+type NetworkConfig struct {
+	Subnet     string   `json:"subnet,omitempty"`
+	GatewayIP  string   `json:"gateway_ip,omitempty"`
+	GatewayMAC string   `json:"gateway_mac,omitempty"`
+	VirtualIPs []string `json:"virtual_ips,omitempty"`
+	MTU        int      `json:"mtu,omitempty"`
+
+	// DNSSearchDomains are sent to the guest with DHCP replies
+	DNSSearchDomains []string `json:"dns_search_domains,omitempty"`
+
+	// GuestIP is the address port forwarding connects to. If GuestMAC is
+	// set, the DHCP server always assigns GuestIP to that MAC address.
+	GuestIP  string `json:"guest_ip,omitempty"`
+	GuestMAC string `json:"guest_mac,omitempty"`
+
+	// Allow and Deny are egress firewall rules in the form accepted by
+	// network.ParseRule. If there are any allow rules, guests can only
+	// reach what they allow outside the subnet.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+
+	// HostIP is a virtual IP that's translated to the loopback address of
+	// the host, which guests can also reach by the name HostAlias. It's
+	// off unless set, since it opens services on the host loopback to
+	// guests. AutoHostIP uses the first virtual IP.
+	HostIP string `json:"host_ip,omitempty"`
+
+	// DNS are static records answered for guests before the DNS server
+	// of the gateway
+	DNS []DNSRecord `json:"dns,omitempty"`
+}
+
+// DNSRecord is a static A or CNAME record
+type DNSRecord struct {
+	Name  string `json:"name"`
+	A     string `json:"a,omitempty"`
+	CNAME string `json:"cname,omitempty"`
+}
+
+// ParseDNSRecord parses a record of the form name:ip for an A record or
+// name:target for a CNAME record
+func ParseDNSRecord(s string) (DNSRecord, error) {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || name == "" || value == "" {
+		return DNSRecord{}, fmt.Errorf("invalid DNS record %q: expected name:ip or name:target", s)
+	}
+	if _, err := netip.ParseAddr(value); err == nil {
+		return DNSRecord{Name: name, A: value}, nil
+	}
+	return DNSRecord{Name: name, CNAME: value}, nil
+}
+
+// Resolve returns the config with defaults filled in, after checking that
+// all addresses are valid and inside the subnet
+func (c NetworkConfig) Resolve() (NetworkConfig, error) {
+	if c.Subnet == "" {
+		c.Subnet = DefaultSubnet
+	}
+	prefix, err := netip.ParsePrefix(c.Subnet)
+	if err != nil {
+		return c, fmt.Errorf("invalid subnet: %w", err)
+	}
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() || prefix.Bits() > 29 {
+		return c, fmt.Errorf("subnet must be IPv4 with room for hosts: %s", c.Subnet)
+	}
+	c.Subnet = prefix.String()
+
+	base := prefix.Addr().As4()
+	var last [4]byte
+	binary.BigEndian.PutUint32(last[:], binary.BigEndian.Uint32(base[:])|(1<<(32-prefix.Bits())-1))
+	broadcast := netip.AddrFrom4(last)
+
+	if c.GatewayIP == "" {
+		c.GatewayIP = prefix.Addr().Next().String()
+	}
+	if c.GatewayMAC == "" {
+		c.GatewayMAC = DefaultGatewayMAC
+	}
+	if c.VirtualIPs == nil {
+		c.VirtualIPs = []string{broadcast.Prev().Prev().String()}
+	}
+	if c.MTU == 0 {
+		c.MTU = DefaultMTU
+	}
+	if c.HostIP == AutoHostIP {
+		if len(c.VirtualIPs) == 0 {
+			return c, fmt.Errorf("host IP needs a virtual IP to use")
+		}
+		c.HostIP = c.VirtualIPs[0]
+	}
+	if c.HostIP != "" && !slices.Contains(c.VirtualIPs, c.HostIP) {
+		c.VirtualIPs = append(slices.Clone(c.VirtualIPs), c.HostIP)
+	}
+	if c.GuestIP == "" {
+		// the DHCP server assigns the lowest address that isn't the gateway
+		ip := prefix.Addr().Next()
+		if ip.String() == c.GatewayIP {
+			ip = ip.Next()
+		}
+		c.GuestIP = ip.String()
+	}
+
+	for _, ip := range append([]string{c.GatewayIP, c.GuestIP}, c.VirtualIPs...) {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return c, fmt.Errorf("invalid address: %w", err)
+		}
+		if !prefix.Contains(addr) || addr == prefix.Addr() || addr == broadcast {
+			return c, fmt.Errorf("address %s is not a host in subnet %s", ip, c.Subnet)
+		}
+	}
+	if c.GuestIP == c.GatewayIP {
+		return c, fmt.Errorf("guest IP and gateway IP are both %s", c.GuestIP)
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		return c, fmt.Errorf("invalid MTU: %d", c.MTU)
+	}
+	if c.GuestIP == c.HostIP {
+		return c, fmt.Errorf("guest IP and host IP are both %s", c.GuestIP)
+	}
+	for _, rule := range append(append([]string{}, c.Allow...), c.Deny...) {
+		if _, err := network.ParseRule(rule); err != nil {
+			return c, err
+		}
+	}
+	if _, err := c.records(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// Records returns the static DNS records of the config, including
+// HostAlias if there's a host IP
+func (c NetworkConfig) Records() (*network.Records, error) {
+	c, err := c.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	return c.records()
+}
+
+func (c NetworkConfig) records() (*network.Records, error) {
+	records := network.NewRecords()
+	if c.HostIP != "" {
+		if err := records.AddA(HostAlias, netip.MustParseAddr(c.HostIP)); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range c.DNS {
+		var err error
+		switch {
+		case r.Name == "" || (r.A == "") == (r.CNAME == ""):
+			err = fmt.Errorf("needs a name and either an A or CNAME value")
+		case r.A != "":
+			var ip netip.Addr
+			if ip, err = netip.ParseAddr(r.A); err == nil {
+				err = records.AddA(r.Name, ip)
+			}
+		default:
+			err = records.AddCNAME(r.Name, r.CNAME)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS record %q: %w", r.Name, err)
+		}
+	}
+	return records, nil
+}
+
+// Policy returns the egress firewall of the config, which is nil if
+// there are no rules
+func (c NetworkConfig) Policy() (*network.Policy, error) {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return nil, nil
+	}
+	c, err := c.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	return network.NewPolicy(c.Subnet, c.GatewayIP, c.GatewayMAC, c.HostIP, c.Allow, c.Deny)
+}
+
+// GuestOptions returns the static guest network settings of a resolved
+// config, with the gateway as DNS server. The address and routes are left
+// out unless the subnet, gateway and guest IP are all known, which they may
+// not be for a relay, so the guest keeps what it got from DHCP.
+func (c NetworkConfig) GuestOptions() GuestNetworkOptions {
+	opts := GuestNetworkOptions{
+		MAC:           c.GuestMAC,
+		SearchDomains: c.DNSSearchDomains,
+		MTU:           c.MTU,
+	}
+	prefix, err := netip.ParsePrefix(c.Subnet)
+	if err != nil || c.GatewayIP == "" {
+		return opts
+	}
+	ip, err := netip.ParseAddr(c.GuestIP)
+	if err != nil {
+		return opts
+	}
+	opts.Address = netip.PrefixFrom(ip, prefix.Bits()).String()
+	opts.Gateway = c.GatewayIP
+	opts.DNS = []string{c.GatewayIP}
+	return opts
+}
+
+// NewNetwork creates a virtual network with the topology of the config
+func NewNetwork(config NetworkConfig) (*vnet.VirtualNetwork, error) {
+	c, err := config.Resolve()
+	if err != nil {
+		return nil, err
+	}
+	vc := &vnet.Configuration{
+		Debug:             false,
+		MTU:               c.MTU,
+		Subnet:            c.Subnet,
+		GatewayIP:         c.GatewayIP,
+		GatewayMacAddress: c.GatewayMAC,
+		GatewayVirtualIPs: c.VirtualIPs,
+		DNSSearchDomains:  c.DNSSearchDomains,
+	}
+	if c.GuestMAC != "" {
+		vc.DHCPStaticLeases = map[string]string{c.GuestIP: c.GuestMAC}
+	}
+	if c.HostIP != "" {
+		vc.NAT = map[string]string{c.HostIP: "127.0.0.1"}
+	}
+	return vnet.New(vc)
+}
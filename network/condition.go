@@ -0,0 +1,225 @@
+package network
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conditions emulate a bad network on the frames between a NIC and the
+// switch. They apply to each direction separately, so a round trip takes
+// twice the latency. Random choices come from Seed, which makes runs with
+// the same traffic reproducible.
+type Conditions struct {
+	// Latency delays every frame
+	Latency time.Duration
+	// Jitter varies the latency of each frame by up to this much either
+	// way. Frames stay in order unless reordered.
+	Jitter time.Duration
+	// Bandwidth is how many bytes per second the link carries. Frames
+	// queue for it, and are dropped when more than QueueLimit are waiting.
+	Bandwidth int
+	// Loss is the fraction of frames that are dropped, from 0 to 1
+	Loss float64
+	// Reorder is the fraction of frames held back by an extra latency, or
+	// 10ms if that's longer, so the frames after them arrive first
+	Reorder float64
+	// Seed seeds random choices. If zero, a random seed is used.
+	Seed int64
+}
+
+// QueueLimit is how many frames can wait for a link with limited bandwidth
+const QueueLimit = 1000
+
+// minReorderDelay is how long reordered frames are held back at least
+const minReorderDelay = 10 * time.Millisecond
+
+// ParseRatio parses a fraction from 0 to 1, or a percentage like 1%
+func ParseRatio(s string) (float64, error) {
+	v := strings.TrimSpace(s)
+	percent := strings.HasSuffix(v, "%")
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ratio %q", s)
+	}
+	if percent {
+		f /= 100
+	}
+	if f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid ratio %q: must be from 0 to 1 or 0%% to 100%%", s)
+	}
+	return f, nil
+}
+
+// Validate checks that the conditions are in range
+func (c Conditions) Validate() error {
+	switch {
+	case c.Latency < 0 || c.Jitter < 0:
+		return fmt.Errorf("latency and jitter can't be negative")
+	case c.Bandwidth < 0:
+		return fmt.Errorf("bandwidth can't be negative")
+	case c.Loss < 0 || c.Loss > 1:
+		return fmt.Errorf("loss must be from 0 to 1: %v", c.Loss)
+	case c.Reorder < 0 || c.Reorder > 1:
+		return fmt.Errorf("reorder must be from 0 to 1: %v", c.Reorder)
+	}
+	return nil
+}
+
+// link carries the frames of one direction under the conditions,
+// delivering them in order of when they're due from its own goroutine
+type link struct {
+	cond    Conditions
+	deliver func(frame []byte)
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	queue   frameQueue
+	seq     uint64
+	free    time.Time   // when the bandwidth is next available
+	sending []time.Time // when frames waiting for bandwidth are sent
+	last    time.Time   // when the last frame in order is due
+	wake    chan struct{}
+	closed  chan struct{}
+}
+
+func newLink(cond Conditions, seed int64, deliver func(frame []byte)) *link {
+	l := &link{
+		cond:    cond,
+		deliver: deliver,
+		rand:    rand.New(rand.NewSource(seed)),
+		wake:    make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// send queues a copy of a frame, unless it's lost or the queue is full
+func (l *link) send(frame []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond.Loss > 0 && l.rand.Float64() < l.cond.Loss {
+		return
+	}
+
+	now := time.Now()
+	sent := now
+	if l.cond.Bandwidth > 0 {
+		for len(l.sending) > 0 && !l.sending[0].After(now) {
+			l.sending = l.sending[1:]
+		}
+		if len(l.sending) >= QueueLimit {
+			return
+		}
+		sent = l.free
+		if sent.Before(now) {
+			sent = now
+		}
+		sent = sent.Add(time.Duration(float64(len(frame)) / float64(l.cond.Bandwidth) * float64(time.Second)))
+		l.free = sent
+		l.sending = append(l.sending, sent)
+	}
+	delay := l.cond.Latency
+	if l.cond.Jitter > 0 {
+		delay += time.Duration(l.rand.Int63n(int64(2*l.cond.Jitter)+1)) - l.cond.Jitter
+		delay = max(delay, 0)
+	}
+	due := sent.Add(delay)
+	if l.cond.Reorder > 0 && l.rand.Float64() < l.cond.Reorder {
+		due = due.Add(max(l.cond.Latency, minReorderDelay))
+	} else {
+		// jitter alone doesn't reorder frames
+		if due.Before(l.last) {
+			due = l.last
+		}
+		l.last = due
+	}
+
+	l.seq++
+	heap.Push(&l.queue, queuedFrame{due: due, seq: l.seq, frame: append([]byte(nil), frame...)})
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (l *link) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		l.mu.Lock()
+		var next *queuedFrame
+		if len(l.queue) > 0 {
+			next = &l.queue[0]
+		}
+		wait := time.Hour
+		if next != nil {
+			wait = time.Until(next.due)
+		}
+		if next != nil && wait <= 0 {
+			f := heap.Pop(&l.queue).(queuedFrame)
+			l.mu.Unlock()
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			l.deliver(f.frame)
+			continue
+		}
+		l.mu.Unlock()
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-l.wake:
+			// a stale tick only causes an extra check
+			timer.Stop()
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// close stops delivering frames and drops any that are queued
+func (l *link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+		l.queue = nil
+	}
+}
+
+type queuedFrame struct {
+	due   time.Time
+	seq   uint64
+	frame []byte
+}
+
+// frameQueue is a heap of frames by when they're due, then by when they
+// were sent
+type frameQueue []queuedFrame
+
+func (q frameQueue) Len() int { return len(q) }
+func (q frameQueue) Less(i, j int) bool {
+	if q[i].due.Equal(q[j].due) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].due.Before(q[j].due)
+}
+func (q frameQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *frameQueue) Push(x any)   { *q = append(*q, x.(queuedFrame)) }
+func (q *frameQueue) Pop() any {
+	old := *q
+	f := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return f
+}
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseRatio(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		err  bool
+	}{
+		{in: "0", want: 0},
+		{in: "0.25", want: 0.25},
+		{in: "1", want: 1},
+		{in: "5%", want: 0.05},
+		{in: " 100% ", want: 1},
+		{in: "0%", want: 0},
+		{in: "", err: true},
+		{in: "%", err: true},
+		{in: "half", err: true},
+		{in: "1.5", err: true},
+		{in: "-0.1", err: true},
+		{in: "101%", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRatio(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseRatio(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRatio(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// runLink sends n one byte frames numbered from 0 through a link and
+// returns the numbers of the frames delivered in order of delivery
+func runLink(t *testing.T, c Conditions, n int) []int {
+	t.Helper()
+	delivered := make(chan int, n)
+	l := newLink(c, c.Seed, func(frame []byte) {
+		delivered <- int(frame[0])
+	})
+	defer l.close()
+	for i := range n {
+		l.send([]byte{byte(i)})
+	}
+	var got []int
+	// lost frames never arrive, so wait until nothing has for a while
+	timeout := time.After(c.Latency + c.Jitter + 2*time.Second)
+	for {
+		select {
+		case i := <-delivered:
+			got = append(got, i)
+			if len(got) == n {
+				return got
+			}
+		case <-time.After(c.Latency + c.Jitter + 200*time.Millisecond):
+			return got
+		case <-timeout:
+			return got
+		}
+	}
+}
+
+func TestLinkConditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cond    Conditions
+		check   func(got []int) bool
+		ordered bool
+	}{
+		{
+			name:    "none",
+			cond:    Conditions{Seed: 1},
+			check:   func(got []int) bool { return len(got) == 100 },
+			ordered: true,
+		},
+		{
+			name:    "all lost",
+			cond:    Conditions{Loss: 1, Seed: 1},
+			check:   func(got []int) bool { return len(got) == 0 },
+			ordered: true,
+		},
+		{
+			name:    "some lost",
+			cond:    Conditions{Loss: 0.3, Seed: 1},
+			check:   func(got []int) bool { return len(got) > 50 && len(got) < 90 },
+			ordered: true,
+		},
+		{
+			name:    "jitter",
+			cond:    Conditions{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 1},
+			check:   func(got []int) bool { return len(got) == 100 },
+			ordered: true,
+		},
+		{
+			name:  "reorder",
+			cond:  Conditions{Reorder: 0.5, Seed: 1},
+			check: func(got []int) bool { return len(got) == 100 && !slices.IsSorted(got) },
+		},
+	}
+	for _, tt := range tests {
+		got := runLink(t, tt.cond, 100)
+		if !tt.check(got) {
+			t.Errorf("%s: delivered %v", tt.name, got)
+		}
+		if tt.ordered && !slices.IsSorted(got) {
+			t.Errorf("%s: frames out of order: %v", tt.name, got)
+		}
+	}
+}
+
+func TestLinkSeed(t *testing.T) {
+	c := Conditions{Loss: 0.5, Seed: 42}
+	first := runLink(t, c, 100)
+	second := runLink(t, c, 100)
+	if !slices.Equal(first, second) {
+		t.Errorf("same seed delivered different frames:\n%v\n%v", first, second)
+	}
+	c.Seed = 43
+	if other := runLink(t, c, 100); slices.Equal(first, other) {
+		t.Errorf("different seeds delivered the same frames: %v", other)
+	}
+}
+
+func TestLinkLatencyAndBandwidth(t *testing.T) {
+	tests := []struct {
+		name string
+		cond Conditions
+		size int
+		min  time.Duration
+	}{
+		{name: "latency", cond: Conditions{Latency: 50 * time.Millisecond, Seed: 1}, size: 100, min: 50 * time.Millisecond},
+		// ten frames of 1000 bytes at 100KB/s take 100ms to send
+		{name: "bandwidth", cond: Conditions{Bandwidth: 100000, Seed: 1}, size: 1000, min: 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		done := make(chan struct{}, 10)
+		l := newLink(tt.cond, tt.cond.Seed, func(frame []byte) {
+			done <- struct{}{}
+		})
+		start := time.Now()
+		for range 10 {
+			l.send(make([]byte, tt.size))
+		}
+		for range 10 {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: frames not delivered", tt.name)
+			}
+		}
+		// timers fire a little early on some platforms
+		if elapsed := time.Since(start); elapsed < tt.min-5*time.Millisecond {
+			t.Errorf("%s: delivered after %v, want at least %v", tt.name, elapsed, tt.min)
+		}
+		l.close()
+	}
+}
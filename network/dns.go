@@ -0,0 +1,200 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Records are static DNS records answered for guests in place of the DNS
+// server of the network. Queries for names that have records never leave
+// the NIC connection, so the names work with any resolver the guest uses.
+type Records struct {
+	mu    sync.RWMutex
+	a     map[string][]netip.Addr
+	cname map[string]string
+}
+
+// NewRecords returns an empty set of records
+func NewRecords() *Records {
+	return &Records{
+		a:     make(map[string][]netip.Addr),
+		cname: make(map[string]string),
+	}
+}
+
+// AddA adds an A record. A name can have several A records but not both
+// A and CNAME records.
+func (r *Records) AddA(name string, ip netip.Addr) error {
+	if !ip.Is4() {
+		return fmt.Errorf("invalid A record for %s: %s is not IPv4", name, ip)
+	}
+	name = canonicalName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cname[name]; ok {
+		return fmt.Errorf("%s already has a CNAME record", name)
+	}
+	r.a[name] = append(r.a[name], ip)
+	return nil
+}
+
+// AddCNAME adds a CNAME record. The target is answered from other records
+// if it has them, otherwise it's resolved by the host.
+func (r *Records) AddCNAME(name, target string) error {
+	name = canonicalName(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.a[name]; ok {
+		return fmt.Errorf("%s already has A records", name)
+	}
+	if _, ok := r.cname[name]; ok {
+		return fmt.Errorf("%s already has a CNAME record", name)
+	}
+	r.cname[name] = canonicalName(target)
+	return nil
+}
+
+func (r *Records) has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, a := r.a[name]
+	_, cname := r.cname[name]
+	return a || cname
+}
+
+// query returns the DNS question of an outbound frame if it asks about a
+// name that has records
+func (r *Records) query(frame []byte) (dnsmessage.Message, bool) {
+	var msg dnsmessage.Message
+	pkt, ok := parsePacket(frame)
+	if !ok || pkt.protocol != "udp" || pkt.port != 53 || pkt.payload == nil {
+		return msg, false
+	}
+	if err := msg.Unpack(pkt.payload); err != nil || msg.Response || len(msg.Questions) != 1 {
+		return msg, false
+	}
+	q := msg.Questions[0]
+	if q.Class != dnsmessage.ClassINET || !r.has(canonicalName(q.Name.String())) {
+		return msg, false
+	}
+	return msg, true
+}
+
+// answer returns the answers for a name, following CNAME records
+func (r *Records) answer(ctx context.Context, q dnsmessage.Question) ([]dnsmessage.Resource, error) {
+	var answers []dnsmessage.Resource
+	name := q.Name
+	for range 8 {
+		r.mu.RLock()
+		ips, isA := r.a[canonicalName(name.String())]
+		target, isCNAME := r.cname[canonicalName(name.String())]
+		r.mu.RUnlock()
+		hdr := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET}
+		switch {
+		case isA:
+			if q.Type != dnsmessage.TypeA {
+				return answers, nil
+			}
+			for _, ip := range ips {
+				answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: ip.As4()}})
+			}
+			return answers, nil
+		case isCNAME:
+			next, err := dnsmessage.NewName(target + ".")
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.CNAMEResource{CNAME: next}})
+			if q.Type == dnsmessage.TypeCNAME {
+				return answers, nil
+			}
+			name = next
+		default:
+			if q.Type != dnsmessage.TypeA {
+				return answers, nil
+			}
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", canonicalName(name.String()))
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range addrs {
+				answers = append(answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: ip.Unmap().As4()}})
+			}
+			return answers, nil
+		}
+	}
+	return nil, fmt.Errorf("too many CNAME records for %s", q.Name)
+}
+
+// reply builds the frame answering a query returned by query, swapping
+// the addresses of the query frame
+func (r *Records) reply(frame []byte, query dnsmessage.Message) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   query.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+	answers, err := r.answer(ctx, query.Questions[0])
+	if err != nil {
+		msg.RCode = dnsmessage.RCodeNameError
+	}
+	for i := range answers {
+		answers[i].Header.TTL = 0
+	}
+	msg.Answers = answers
+	payload, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ihl := int(frame[14]&0x0f) * 4
+	reply := make([]byte, 14+20+8+len(payload))
+	copy(reply[0:6], frame[6:12])
+	copy(reply[6:12], frame[0:6])
+	copy(reply[12:14], frame[12:14])
+	ip := reply[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], frame[14+16:14+20])
+	copy(ip[16:20], frame[14+12:14+16])
+	binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:20]))
+	udp := ip[20:]
+	copy(udp[0:2], frame[14+ihl+2:14+ihl+4])
+	copy(udp[2:4], frame[14+ihl:14+ihl+2])
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	// a zero UDP checksum means none over IPv4
+	copy(udp[8:], payload)
+	return reply, nil
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -1,66 +1,247 @@
 package network
 
 import (
+	"crypto/subtle"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/progrium/go-netstack/vnet"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
-func Handler(vn *vnet.VirtualNetwork) http.Handler {
+// Options are applied to NIC connections and their frames
+type Options struct {
+	// Policy filters frames from NICs if set
+	Policy *Policy
+	// Records answers DNS queries from NICs for static names if set
+	Records *Records
+	// Taps are called with every frame that passes
+	Taps []Tap
+	// Conditions emulate a bad network on the frames of each NIC if set
+	Conditions *Conditions
+
+	// Token, if set, is required of every request as the token query
+	// parameter or a bearer token in the Authorization header
+	Token string
+	// Origins, if set, are the only origins browsers can connect from,
+	// where "*" allows any. Clients that don't send an origin, which
+	// browsers always do, aren't checked.
+	Origins []string
+	// MaxConns limits how many NICs can be connected at once
+	MaxConns int
+	// RateLimit limits how many bytes per second each NIC can send
+	RateLimit int
+	// Services serves the vnet tunnel and leases endpoints next to the
+	// NIC endpoint, which network relays need but VMs shouldn't expose
+	Services bool
+}
+
+// maxFrameSize is the largest websocket message accepted from a NIC, which
+// is enough for an Ethernet frame at the largest MTU
+const maxFrameSize = 65536 + 64
+
+// authorized checks the token of a request
+func (o Options) authorized(r *http.Request) bool {
+	if o.Token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(o.Token)) == 1
+}
+
+func (o Options) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(o.Origins) == 0 || origin == "" {
+		return true
+	}
+	for _, allowed := range o.Origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler accepts websocket NIC connections to the virtual network. With
+// Services set, other requests to a path ending in /tunnel or /leases are
+// served by those vnet endpoints, which lets VMs that join the network as
+// a relay dial into it and find the address of their guest.
+func Handler(vn *vnet.VirtualNetwork, opts Options) http.Handler {
+	var services http.Handler
+	if vn != nil {
+		services = vn.Mux()
+	}
+	conns := new(atomic.Int32)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if vn == nil {
 			http.Error(w, "network not available", http.StatusNotFound)
 			return
 		}
-		if !websocket.IsWebSocketUpgrade(r) {
-			http.Error(w, "expecting websocket upgrade", http.StatusBadRequest)
+		if !opts.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-
-		ws, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Println(err)
+		if name := path.Base(r.URL.Path); opts.Services && !websocket.IsWebSocketUpgrade(r) && (name == "tunnel" || name == "leases") {
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + name
+			services.ServeHTTP(w, r)
 			return
 		}
-		defer ws.Close()
+		serveQemu(w, r, opts, conns, func(conn net.Conn) error {
+			return vn.AcceptQemu(r.Context(), conn)
+		})
+	})
+}
 
-		if err := vn.AcceptQemu(r.Context(), &qemuAdapter{Conn: ws}); err != nil {
-			if strings.Contains(err.Error(), "websocket: close") {
-				return
-			}
-			log.Println(err)
+// PipeHandler relays Ethernet frames between a websocket NIC connection
+// and conn, using the same 32-bit big endian length prefixed framing
+// the virtual network speaks. This lets something other than vnet act
+// as the switch on the other end of the NIC.
+func PipeHandler(conn io.ReadWriter, opts Options) http.Handler {
+	conns := new(atomic.Int32)
+	pr := &pipeReader{
+		frames: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !opts.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		serveQemu(w, r, opts, conns, func(qemu net.Conn) error {
+			pr.once.Do(func() { go pr.read(conn) })
+			errs := make(chan error, 1)
+			go func() {
+				_, err := io.Copy(conn, qemu)
+				errs <- err
+			}()
+			for {
+				select {
+				case frame := <-pr.frames:
+					if _, err := qemu.Write(frame); err != nil {
+						return err
+					}
+				case err := <-errs:
+					return err
+				case <-pr.done:
+					return pr.err
+				}
+			}
+		})
 	})
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// pipeReader reads the frames coming from the conn of a PipeHandler and
+// hands them to whichever session is connected. Frames wait for the next
+// session when none is, and a session that ends leaves nothing reading
+// conn that would take frames meant for the one after it.
+type pipeReader struct {
+	once   sync.Once
+	frames chan []byte
+	done   chan struct{}
+	err    error
+}
+
+func (pr *pipeReader) read(conn io.Reader) {
+	defer close(pr.done)
+	for {
+		frame := make([]byte, 4)
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			pr.err = err
+			return
+		}
+		length := binary.BigEndian.Uint32(frame)
+		if length > maxFrameSize {
+			pr.err = fmt.Errorf("frame of %d bytes is too large", length)
+			return
+		}
+		frame = append(frame, make([]byte, length)...)
+		if _, err := io.ReadFull(conn, frame[4:]); err != nil {
+			pr.err = err
+			return
+		}
+		pr.frames <- frame
+	}
+}
+
+func serveQemu(w http.ResponseWriter, r *http.Request, opts Options, conns *atomic.Int32, accept func(conn net.Conn) error) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "expecting websocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if n := conns.Add(1); opts.MaxConns > 0 && int(n) > opts.MaxConns {
+		conns.Add(-1)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer conns.Add(-1)
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     opts.checkOrigin,
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(maxFrameSize)
+
+	q := &qemuAdapter{Conn: ws, opts: opts}
+	if opts.RateLimit > 0 {
+		q.limiter = newRateLimiter(opts.RateLimit)
+	}
+	if opts.Conditions != nil {
+		q.condition(*opts.Conditions)
+		defer q.closeLinks()
+	}
+	if err := accept(q); err != nil {
+		if strings.Contains(err.Error(), "websocket: close") {
+			return
+		}
+		log.Println(err)
+		return
+	}
 }
 
 type qemuAdapter struct {
 	*websocket.Conn
+	opts        Options
+	limiter     *rateLimiter
 	mu          sync.Mutex
 	readBuffer  []byte
 	writeBuffer []byte
 	readOffset  int
+
+	// with conditions, frames go through a link in each direction
+	outbound *link
+	inbound  *link
+	frames   chan []byte
+	readErr  error
+	readDone chan struct{}
+	writeErr error
+	done     chan struct{}
 }
 
 func (q *qemuAdapter) Read(p []byte) (n int, err error) {
-	if len(q.readBuffer) == 0 {
-		_, message, err := q.ReadMessage()
+	for len(q.readBuffer) == 0 {
+		message, err := q.readFrame()
 		if err != nil {
 			return 0, err
 		}
@@ -69,6 +250,7 @@ func (q *qemuAdapter) Read(p []byte) (n int, err error) {
 		binary.BigEndian.PutUint32(lengthPrefix, length)
 		q.readBuffer = append(lengthPrefix, message...)
 		q.readOffset = 0
+		q.tap(Outbound, message)
 	}
 
 	n = copy(p, q.readBuffer[q.readOffset:])
@@ -79,6 +261,85 @@ func (q *qemuAdapter) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// readFrame returns the next frame from the NIC for the switch
+func (q *qemuAdapter) readFrame() ([]byte, error) {
+	if q.outbound == nil {
+		return q.nextFrame()
+	}
+	select {
+	case frame := <-q.frames:
+		return frame, nil
+	case <-q.readDone:
+		return nil, q.readErr
+	}
+}
+
+// nextFrame reads messages from the NIC until one passes the policy
+func (q *qemuAdapter) nextFrame() ([]byte, error) {
+	for {
+		_, message, err := q.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if q.opts.Records != nil {
+			if query, ok := q.opts.Records.query(message); ok {
+				q.tap(Outbound, message)
+				go q.answer(message, query)
+				continue
+			}
+		}
+		if q.opts.Policy != nil && !q.opts.Policy.Filter(Outbound, message) {
+			continue
+		}
+		if q.limiter != nil {
+			q.limiter.wait(len(message))
+		}
+		return message, nil
+	}
+}
+
+// condition starts passing frames through links with the conditions
+func (q *qemuAdapter) condition(c Conditions) {
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	q.frames = make(chan []byte)
+	q.readDone = make(chan struct{})
+	q.done = make(chan struct{})
+	q.outbound = newLink(c, seed, func(frame []byte) {
+		select {
+		case q.frames <- frame:
+		case <-q.done:
+		}
+	})
+	q.inbound = newLink(c, seed+1, func(frame []byte) {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.writeErr != nil {
+			return
+		}
+		q.writeErr = q.sendFrame(frame)
+	})
+	go func() {
+		for {
+			frame, err := q.nextFrame()
+			if err != nil {
+				q.readErr = err
+				close(q.readDone)
+				return
+			}
+			q.outbound.send(frame)
+		}
+	}()
+}
+
+func (q *qemuAdapter) closeLinks() {
+	close(q.done)
+	q.outbound.close()
+	q.inbound.close()
+}
+
 func (q *qemuAdapter) Write(p []byte) (int, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -94,8 +355,7 @@ func (q *qemuAdapter) Write(p []byte) (int, error) {
 		return len(p), nil
 	}
 
-	err := q.WriteMessage(websocket.BinaryMessage, q.writeBuffer[4:4+length])
-	if err != nil {
+	if err := q.writeFrame(q.writeBuffer[4 : 4+length]); err != nil {
 		return 0, err
 	}
 
@@ -103,6 +363,59 @@ func (q *qemuAdapter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// writeFrame sends a frame to the NIC, through the inbound link if there
+// is one. It must be called with q.mu held.
+func (q *qemuAdapter) writeFrame(frame []byte) error {
+	if q.opts.Policy != nil {
+		q.opts.Policy.Filter(Inbound, frame)
+	}
+	if q.inbound != nil {
+		if q.writeErr != nil {
+			return q.writeErr
+		}
+		q.inbound.send(frame)
+		return nil
+	}
+	return q.sendFrame(frame)
+}
+
+// sendFrame writes a frame to the NIC. It must be called with q.mu held.
+func (q *qemuAdapter) sendFrame(frame []byte) error {
+	if err := q.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		return err
+	}
+	q.tap(Inbound, frame)
+	return nil
+}
+
+// answer replies to a DNS query for static records, which may need to
+// resolve the target of a CNAME record
+func (q *qemuAdapter) answer(frame []byte, query dnsmessage.Message) {
+	reply, err := q.opts.Records.reply(frame, query)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if q.opts.Policy != nil {
+		q.opts.Policy.learnAnswer(reply)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.writeFrame(reply); err != nil && !strings.Contains(err.Error(), "websocket: close") {
+		log.Println(err)
+	}
+}
+
+func (q *qemuAdapter) tap(dir Direction, frame []byte) {
+	if len(q.opts.Taps) == 0 {
+		return
+	}
+	now := time.Now()
+	for _, tap := range q.opts.Taps {
+		tap(now, dir, frame)
+	}
+}
+
 func (c *qemuAdapter) LocalAddr() net.Addr {
 	return &net.UnixAddr{}
 }
@@ -120,3 +433,30 @@ func (c *qemuAdapter) SetReadDeadline(t time.Time) error {
 func (c *qemuAdapter) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+// rateLimiter is a token bucket that allows bursts of up to a second of
+// traffic. It's only used by the goroutine reading from a NIC.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n bytes from the bucket, sleeping until they're available
+func (l *rateLimiter) wait(n int) {
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction is which way a frame is going relative to the VM NIC
+type Direction int
+
+const (
+	// Inbound frames are sent to the NIC by the network
+	Inbound Direction = iota + 1
+	// Outbound frames are sent by the NIC to the network
+	Outbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Inbound:
+		return "in"
+	case Outbound:
+		return "out"
+	default:
+		return "unknown"
+	}
+}
+
+// Tap is called with every Ethernet frame that passes through a NIC
+// connection. The frame is only valid for the duration of the call.
+type Tap func(t time.Time, dir Direction, frame []byte)
+
+const (
+	pcapSnapLen      = 65535
+	linkTypeEthernet = 1
+)
+
+// Capture writes frames to a pcap or pcapng file. Its Tap method can be
+// passed to Handler and PipeHandler. Each frame is written with a single
+// call to the underlying writer, so nothing is lost if the process exits
+// without closing it.
+type Capture struct {
+	mu     sync.Mutex
+	w      io.Writer
+	pcapng bool
+	err    error
+}
+
+// NewCapture writes the file header of a pcap file to w, or a pcapng file
+// if pcapng is set, and returns a Capture that writes frames to it
+func NewCapture(w io.Writer, pcapng bool) (*Capture, error) {
+	c := &Capture{w: w, pcapng: pcapng}
+	var header []byte
+	if pcapng {
+		header = append(pcapngSectionHeader(), pcapngInterfaceDescription()...)
+	} else {
+		header = make([]byte, 24)
+		binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(header[4:], 2)
+		binary.LittleEndian.PutUint16(header[6:], 4)
+		binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CreateCapture creates a capture file at path, which is pcapng if the
+// path ends in .pcapng and pcap otherwise
+func CreateCapture(path string) (*Capture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCapture(f, strings.EqualFold(filepath.Ext(path), ".pcapng"))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Tap writes a frame to the capture. Write errors stop the capture and
+// are returned by Err and Close.
+func (c *Capture) Tap(t time.Time, dir Direction, frame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	var record []byte
+	if c.pcapng {
+		record = pcapngEnhancedPacket(t, dir, frame)
+	} else {
+		captured := frame
+		if len(captured) > pcapSnapLen {
+			captured = captured[:pcapSnapLen]
+		}
+		record = make([]byte, 16, 16+len(captured))
+		binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(captured)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+		record = append(record, captured...)
+	}
+	_, c.err = c.w.Write(record)
+}
+
+// Err returns the error that stopped the capture, if any
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the underlying writer if it's an io.Closer
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.err
+	if closer, ok := c.w.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if c.err == nil {
+		c.err = os.ErrClosed
+	}
+	return err
+}
+
+// pcapngBlock lays out a block with its type, total length, body padded
+// to 32 bits, and total length again
+func pcapngBlock(typ uint32, body []byte) []byte {
+	padded := (len(body) + 3) &^ 3
+	b := make([]byte, 12+padded)
+	binary.LittleEndian.PutUint32(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(b)))
+	return b
+}
+
+func pcapngSectionHeader() []byte {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	binary.LittleEndian.PutUint64(body[8:], 0xffffffffffffffff) // unknown section length
+	return pcapngBlock(0x0a0d0d0a, body)
+}
+
+func pcapngInterfaceDescription() []byte {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], linkTypeEthernet)
+	binary.LittleEndian.PutUint32(body[4:], pcapSnapLen)
+	// timestamps use the default resolution of microseconds
+	return pcapngBlock(1, body)
+}
+
+func pcapngEnhancedPacket(t time.Time, dir Direction, frame []byte) []byte {
+	captured := frame
+	if len(captured) > pcapSnapLen {
+		captured = captured[:pcapSnapLen]
+	}
+	padded := (len(captured) + 3) &^ 3
+	body := make([]byte, 20+padded, 20+padded+16)
+	ts := uint64(t.UnixMicro())
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(frame)))
+	copy(body[20:], captured)
+	// epb_flags option with the direction in its lowest two bits
+	// followed by the end of options
+	opts := make([]byte, 12)
+	binary.LittleEndian.PutUint16(opts[0:], 2)
+	binary.LittleEndian.PutUint16(opts[2:], 4)
+	binary.LittleEndian.PutUint32(opts[4:], uint32(dir)&0x3)
+	body = append(body, opts...)
+	return pcapngBlock(6, body)
+}
@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestCapturePcap(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	c.Tap(ts, Outbound, []byte{1, 2, 3})
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if len(b) != 24+16+3 {
+		t.Fatalf("got %d bytes, want %d", len(b), 24+16+3)
+	}
+	le := binary.LittleEndian
+	header := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"magic", le.Uint32(b[0:]), 0xa1b2c3d4},
+		{"major version", uint32(le.Uint16(b[4:])), 2},
+		{"minor version", uint32(le.Uint16(b[6:])), 4},
+		{"snaplen", le.Uint32(b[16:]), pcapSnapLen},
+		{"link type", le.Uint32(b[20:]), linkTypeEthernet},
+		{"seconds", le.Uint32(b[24:]), 1700000000},
+		{"microseconds", le.Uint32(b[28:]), 123456},
+		{"captured length", le.Uint32(b[32:]), 3},
+		{"original length", le.Uint32(b[36:]), 3},
+	}
+	for _, h := range header {
+		if h.got != h.want {
+			t.Errorf("%s: got %#x, want %#x", h.name, h.got, h.want)
+		}
+	}
+	if !bytes.Equal(b[40:], []byte{1, 2, 3}) {
+		t.Errorf("frame: got %v", b[40:])
+	}
+}
+
+func TestCapturePcapng(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.UnixMicro(0x0102030405)
+	c.Tap(ts, Inbound, []byte{1, 2, 3, 4, 5})
+
+	le := binary.LittleEndian
+	b := buf.Bytes()
+	var blocks [][]byte
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %v", b)
+		}
+		n := le.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) || le.Uint32(b[n-4:]) != n {
+			t.Fatalf("bad block length %d", n)
+		}
+		blocks = append(blocks, b[:n])
+		b = b[n:]
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(blocks))
+	}
+
+	fields := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"section header type", le.Uint32(blocks[0][0:]), 0x0a0d0d0a},
+		{"byte order magic", le.Uint32(blocks[0][8:]), 0x1a2b3c4d},
+		{"major version", uint32(le.Uint16(blocks[0][12:])), 1},
+		{"interface type", le.Uint32(blocks[1][0:]), 1},
+		{"link type", uint32(le.Uint16(blocks[1][8:])), linkTypeEthernet},
+		{"snaplen", le.Uint32(blocks[1][12:]), pcapSnapLen},
+		{"packet type", le.Uint32(blocks[2][0:]), 6},
+		{"interface id", le.Uint32(blocks[2][8:]), 0},
+		{"timestamp high", le.Uint32(blocks[2][12:]), 0x01},
+		{"timestamp low", le.Uint32(blocks[2][16:]), 0x02030405},
+		{"captured length", le.Uint32(blocks[2][20:]), 5},
+		{"original length", le.Uint32(blocks[2][24:]), 5},
+		{"flags option", uint32(le.Uint16(blocks[2][36:])), 2},
+		{"flags length", uint32(le.Uint16(blocks[2][38:])), 4},
+		{"direction", le.Uint32(blocks[2][40:]), uint32(Inbound)},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s: got %#x, want %#x", f.name, f.got, f.want)
+		}
+	}
+	if frame := blocks[2][28:33]; !bytes.Equal(frame, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("frame: got %v", frame)
+	}
+}
+
+func TestCaptureSnapLen(t *testing.T) {
+	for _, pcapng := range []bool{false, true} {
+		var buf bytes.Buffer
+		c, err := NewCapture(&buf, pcapng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headerLen := buf.Len()
+		c.Tap(time.Now(), Outbound, make([]byte, pcapSnapLen+100))
+		record := buf.Bytes()[headerLen:]
+		off := 8
+		if pcapng {
+			off = 20
+		}
+		captured := binary.LittleEndian.Uint32(record[off:])
+		original := binary.LittleEndian.Uint32(record[off+4:])
+		if captured != pcapSnapLen || original != pcapSnapLen+100 {
+			t.Errorf("pcapng %v: got lengths %d and %d", pcapng, captured, original)
+		}
+	}
+}
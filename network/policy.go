@@ -0,0 +1,430 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Rule matches outbound IPv4 packets by destination, port and protocol
+type Rule struct {
+	// Protocol is "tcp", "udp", "icmp", or empty for any protocol
+	Protocol string
+	// Prefix is the destination network, which is invalid if the rule
+	// matches by Host or any destination
+	Prefix netip.Prefix
+	// Host is a DNS name the destination was resolved from, which
+	// matches subdomains if it starts with "*."
+	Host string
+	// PortMin and PortMax are an inclusive range of destination ports,
+	// which are zero to match any port
+	PortMin, PortMax int
+}
+
+// ParseRule parses a rule of the form destination[:port[-port]][/protocol]
+// where the destination is an IP, a CIDR, a DNS name, a wildcard DNS name
+// like *.example.com, or * for any destination. For example 10.0.0.0/8,
+// mirror.internal:443/tcp or *:53/udp.
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	spec := s
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		switch proto := strings.ToLower(spec[i+1:]); proto {
+		case "tcp", "udp", "icmp":
+			r.Protocol = proto
+			spec = spec[:i]
+		}
+	}
+	dest, ports, hasPort := strings.Cut(spec, ":")
+	if hasPort {
+		if r.Protocol == "icmp" {
+			return r, fmt.Errorf("invalid rule %q: icmp has no ports", s)
+		}
+		min, max, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			max = min
+		}
+		var err error
+		if r.PortMin, err = strconv.Atoi(min); err == nil {
+			r.PortMax, err = strconv.Atoi(max)
+		}
+		if err != nil || r.PortMin < 1 || r.PortMax > 65535 || r.PortMin > r.PortMax {
+			return r, fmt.Errorf("invalid rule %q: invalid port %q", s, ports)
+		}
+	}
+	switch {
+	case dest == "*" || dest == "":
+	case strings.Contains(dest, "/"):
+		prefix, err := netip.ParsePrefix(dest)
+		if err != nil || !prefix.Addr().Is4() {
+			return r, fmt.Errorf("invalid rule %q: invalid IPv4 network %q", s, dest)
+		}
+		r.Prefix = prefix.Masked()
+	default:
+		if addr, err := netip.ParseAddr(dest); err == nil {
+			if !addr.Is4() {
+				return r, fmt.Errorf("invalid rule %q: only IPv4 is supported", s)
+			}
+			r.Prefix = netip.PrefixFrom(addr, 32)
+			break
+		}
+		name := strings.ToLower(strings.TrimSuffix(dest, "."))
+		if strings.Contains(strings.TrimPrefix(name, "*."), "*") || strings.ContainsAny(name, " /") {
+			return r, fmt.Errorf("invalid rule %q: invalid destination %q", s, dest)
+		}
+		r.Host = name
+	}
+	return r, nil
+}
+
+func (r Rule) String() string {
+	dest := "*"
+	if r.Host != "" {
+		dest = r.Host
+	} else if r.Prefix.IsValid() {
+		dest = r.Prefix.String()
+		if r.Prefix.IsSingleIP() {
+			dest = r.Prefix.Addr().String()
+		}
+	}
+	if r.PortMin != 0 {
+		dest += ":" + strconv.Itoa(r.PortMin)
+		if r.PortMax != r.PortMin {
+			dest += "-" + strconv.Itoa(r.PortMax)
+		}
+	}
+	if r.Protocol != "" {
+		dest += "/" + r.Protocol
+	}
+	return dest
+}
+
+func (r Rule) match(p packet, names []string) bool {
+	if r.Protocol != "" && r.Protocol != p.protocol {
+		return false
+	}
+	if r.PortMin != 0 && (p.port < r.PortMin || p.port > r.PortMax) {
+		return false
+	}
+	if r.Prefix.IsValid() {
+		return r.Prefix.Contains(p.dst)
+	}
+	if r.Host != "" {
+		for _, name := range names {
+			if name == r.Host || (strings.HasPrefix(r.Host, "*.") && strings.HasSuffix(name, r.Host[1:])) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Policy is an egress firewall for the guests of a virtual network. It
+// filters outbound IPv4 packets to destinations outside the subnet, so
+// DHCP, DNS from the gateway, and traffic between guests always pass.
+// The address that reaches the host, if any, counts as outside.
+// Deny rules take precedence over allow rules, and if there are any
+// allow rules, packets they don't match are denied. Denied packets are
+// dropped and logged.
+//
+// Rules by DNS name match destinations the guest looked up with DNS, which
+// the policy learns by watching the answers the gateway and static records
+// send to the guest. They don't match connections to addresses the guest
+// got some other way.
+type Policy struct {
+	Allow []Rule
+	Deny  []Rule
+
+	subnet     netip.Prefix
+	host       netip.Addr
+	gateway    netip.Addr
+	gatewayMAC [6]byte
+
+	mu      sync.Mutex
+	names   map[netip.Addr]learned
+	learned uint64
+	logged  map[string]time.Time
+}
+
+// learned are the names an address was looked up by, and when in the
+// order of answers it was last looked up
+type learned struct {
+	names []string
+	seq   uint64
+}
+
+const (
+	// maxLearned is how many addresses the names are remembered for, after
+	// which those learned longest ago are forgotten
+	maxLearned = 4096
+	// maxNames is how many names are remembered for an address
+	maxNames = 16
+	// maxLogged is how many denied flows are remembered to not log again
+	maxLogged = 1024
+)
+
+// NewPolicy parses allow and deny rules into a policy for a network with
+// the given subnet, gateway and address that reaches the host, which may
+// be empty
+func NewPolicy(subnet, gatewayIP, gatewayMAC, hostIP string, allow, deny []string) (*Policy, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet: %w", err)
+	}
+	gateway, err := netip.ParseAddr(gatewayIP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway IP: %w", err)
+	}
+	mac, err := net.ParseMAC(gatewayMAC)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid gateway MAC: %q", gatewayMAC)
+	}
+	var host netip.Addr
+	if hostIP != "" {
+		host, err = netip.ParseAddr(hostIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host IP: %w", err)
+		}
+	}
+	p := &Policy{
+		host:       host,
+		subnet:     prefix.Masked(),
+		gateway:    gateway,
+		gatewayMAC: [6]byte(mac),
+		names:      make(map[netip.Addr]learned),
+		logged:     make(map[string]time.Time),
+	}
+	for _, s := range allow {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.Allow = append(p.Allow, r)
+	}
+	for _, s := range deny {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.Deny = append(p.Deny, r)
+	}
+	return p, nil
+}
+
+// Filter reports whether a frame should pass. Inbound frames always pass
+// but DNS answers in them from the gateway are remembered for rules by DNS
+// name. Answers from anywhere else are ignored, since other guests on the
+// network could send them to make a denied address match an allowed name.
+func (p *Policy) Filter(dir Direction, frame []byte) bool {
+	pkt, ok := parsePacket(frame)
+	if !ok {
+		return true
+	}
+	if dir == Inbound {
+		if pkt.protocol == "udp" && pkt.srcPort == 53 && pkt.src == p.gateway && pkt.srcMAC == p.gatewayMAC {
+			p.learn(pkt.payload)
+		}
+		return true
+	}
+	if (p.subnet.Contains(pkt.dst) && pkt.dst != p.host) || pkt.dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || pkt.dst.IsMulticast() {
+		return true
+	}
+	if p.Allowed(pkt.protocol, pkt.dst, pkt.port) {
+		return true
+	}
+	p.logDenied(pkt)
+	return false
+}
+
+// Allowed reports whether the policy allows a packet with the protocol,
+// destination and port. The port is zero for protocols without ports.
+func (p *Policy) Allowed(protocol string, dst netip.Addr, port int) bool {
+	pkt := packet{protocol: protocol, dst: dst, port: port}
+	names := p.lookup(dst)
+	for _, r := range p.Deny {
+		if r.match(pkt, names) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, r := range p.Allow {
+		if r.match(pkt, names) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) lookup(addr netip.Addr) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.names[addr].names)
+}
+
+// learnAnswer remembers the names in a DNS answer frame made by Records,
+// which is trusted wherever it says it's from
+func (p *Policy) learnAnswer(frame []byte) {
+	if pkt, ok := parsePacket(frame); ok && pkt.protocol == "udp" {
+		p.learn(pkt.payload)
+	}
+}
+
+// learn records the names of the A records in a DNS response, including
+// the names of any CNAME records that led to them
+func (p *Policy) learn(payload []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(payload); err != nil || !msg.Response {
+		return
+	}
+	aliases := make(map[string][]string)
+	for _, rr := range msg.Answers {
+		if cname, ok := rr.Body.(*dnsmessage.CNAMEResource); ok {
+			target := dnsName(cname.CNAME)
+			aliases[target] = append(aliases[target], dnsName(rr.Header.Name))
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, rr := range msg.Answers {
+		a, ok := rr.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		addr := netip.AddrFrom4(a.A)
+		entry, ok := p.names[addr]
+		if !ok && len(p.names) >= maxLearned {
+			p.forgetOldest()
+		}
+		p.learned++
+		entry.seq = p.learned
+		seen := make(map[string]bool)
+		pending := []string{dnsName(rr.Header.Name)}
+		for len(pending) > 0 {
+			name := pending[0]
+			pending = pending[1:]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			pending = append(pending, aliases[name]...)
+			if !slices.Contains(entry.names, name) && len(entry.names) < maxNames {
+				entry.names = append(entry.names, name)
+			}
+		}
+		p.names[addr] = entry
+	}
+}
+
+// forgetOldest forgets the names of the address learned longest ago. It
+// must be called with p.mu held.
+func (p *Policy) forgetOldest() {
+	var oldest netip.Addr
+	var oldestSeq uint64
+	for addr, entry := range p.names {
+		if !oldest.IsValid() || entry.seq < oldestSeq {
+			oldest, oldestSeq = addr, entry.seq
+		}
+	}
+	delete(p.names, oldest)
+}
+
+// logDenied logs a denied packet unless the same flow was logged in the
+// last ten seconds, since guests retry
+func (p *Policy) logDenied(pkt packet) {
+	dst := pkt.dst.String()
+	if pkt.port != 0 {
+		dst += ":" + strconv.Itoa(pkt.port)
+	}
+	key := pkt.protocol + " " + dst
+	now := time.Now()
+	p.mu.Lock()
+	last, seen := p.logged[key]
+	skip := seen && now.Sub(last) < 10*time.Second
+	if !skip && !seen && len(p.logged) >= maxLogged {
+		for k, t := range p.logged {
+			if now.Sub(t) >= 10*time.Second {
+				delete(p.logged, k)
+			}
+		}
+		// more new flows than this in ten seconds is a scan, which would
+		// only flood the log
+		skip = len(p.logged) >= maxLogged
+	}
+	if !skip {
+		p.logged[key] = now
+	}
+	names := p.names[pkt.dst].names
+	p.mu.Unlock()
+	if skip {
+		return
+	}
+	if len(names) > 0 {
+		dst += " (" + strings.Join(names, ", ") + ")"
+	}
+	log.Printf("network: denied %s to %s", pkt.protocol, dst)
+}
+
+type packet struct {
+	protocol string
+	srcMAC   [6]byte
+	src      netip.Addr
+	dst      netip.Addr
+	port     int
+	srcPort  int
+	payload  []byte
+}
+
+// parsePacket reads the IPv4 header of an Ethernet frame and the ports of
+// a TCP or UDP packet in it. Fragments after the first have no ports.
+func parsePacket(frame []byte) (packet, bool) {
+	var p packet
+	if len(frame) < 14+20 || binary.BigEndian.Uint16(frame[12:]) != 0x0800 {
+		return p, false
+	}
+	ip := frame[14:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ip[0]>>4 != 4 || ihl < 20 || len(ip) < ihl {
+		return p, false
+	}
+	p.srcMAC = [6]byte(frame[6:12])
+	p.src = netip.AddrFrom4([4]byte(ip[12:16]))
+	p.dst = netip.AddrFrom4([4]byte(ip[16:20]))
+	switch ip[9] {
+	case 1:
+		p.protocol = "icmp"
+	case 6:
+		p.protocol = "tcp"
+	case 17:
+		p.protocol = "udp"
+	default:
+		p.protocol = strconv.Itoa(int(ip[9]))
+	}
+	fragOffset := binary.BigEndian.Uint16(ip[6:]) & 0x1fff
+	l4 := ip[ihl:]
+	if (p.protocol == "tcp" || p.protocol == "udp") && fragOffset == 0 && len(l4) >= 4 {
+		p.srcPort = int(binary.BigEndian.Uint16(l4[0:]))
+		p.port = int(binary.BigEndian.Uint16(l4[2:]))
+	}
+	if p.protocol == "udp" && fragOffset == 0 && len(l4) >= 8 {
+		if n := int(binary.BigEndian.Uint16(l4[4:])); n >= 8 && len(l4) >= n {
+			p.payload = l4[8:n]
+		}
+	}
+	return p, true
+}
+
+func dnsName(n dnsmessage.Name) string {
+	return strings.ToLower(strings.TrimSuffix(n.String(), "."))
+}
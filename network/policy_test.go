@@ -0,0 +1,178 @@
+package network
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rule
+		err  bool
+	}{
+		{in: "*", want: Rule{}},
+		{in: "10.0.0.0/8", want: Rule{Prefix: netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "10.1.2.3/8", want: Rule{Prefix: netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "1.1.1.1", want: Rule{Prefix: netip.MustParsePrefix("1.1.1.1/32")}},
+		{in: "1.1.1.1/icmp", want: Rule{Protocol: "icmp", Prefix: netip.MustParsePrefix("1.1.1.1/32")}},
+		{in: "*:53/udp", want: Rule{Protocol: "udp", PortMin: 53, PortMax: 53}},
+		{in: "10.0.0.0/8:8000-8080/TCP", want: Rule{Protocol: "tcp", Prefix: netip.MustParsePrefix("10.0.0.0/8"), PortMin: 8000, PortMax: 8080}},
+		{in: "Mirror.Internal.:443/tcp", want: Rule{Protocol: "tcp", Host: "mirror.internal", PortMin: 443, PortMax: 443}},
+		{in: "*.example.com", want: Rule{Host: "*.example.com"}},
+		{in: "1.1.1.1:53/icmp", err: true},
+		{in: "*:0", err: true},
+		{in: "*:70000", err: true},
+		{in: "*:90-80", err: true},
+		{in: "*:http", err: true},
+		{in: "10.0.0.0/33", err: true},
+		{in: "::1", err: true},
+		{in: "fd00::/8", err: true},
+		{in: "foo.*.com", err: true},
+		{in: "a b", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRule(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseRule(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRule(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+var (
+	testGuestMAC   = [6]byte{0x02, 0, 0, 0, 0, 0x0f}
+	testGatewayMAC = [6]byte{0x5a, 0x94, 0xef, 0xe4, 0x0c, 0xdd}
+	testGuest      = netip.MustParseAddr("192.168.127.3")
+	testGateway    = netip.MustParseAddr("192.168.127.1")
+)
+
+// testFrame builds an Ethernet frame with an IPv4 TCP or UDP packet
+func testFrame(srcMAC [6]byte, src, dst netip.Addr, proto string, srcPort, dstPort int, payload []byte) []byte {
+	frame := make([]byte, 14+20+8+len(payload))
+	copy(frame[0:6], testGuestMAC[:])
+	copy(frame[6:12], srcMAC[:])
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)))
+	ip[8] = 64
+	ip[9] = 17
+	if proto == "tcp" {
+		ip[9] = 6
+	}
+	src4, dst4 := src.As4(), dst.As4()
+	copy(ip[12:16], src4[:])
+	copy(ip[16:20], dst4[:])
+	l4 := ip[20:]
+	binary.BigEndian.PutUint16(l4[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(l4[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(l4[4:], uint16(8+len(payload)))
+	copy(l4[8:], payload)
+	return frame
+}
+
+// testAnswer packs a DNS response with a CNAME from name to target and
+// an A record for target
+func testAnswer(t *testing.T, name, target string, addr netip.Addr) []byte {
+	hdr := func(n string) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(n), Class: dnsmessage.ClassINET}
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{
+			{Header: hdr(name), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)}},
+			{Header: hdr(target), Body: &dnsmessage.AResource{A: addr.As4()}},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPolicyFilter(t *testing.T) {
+	p, err := NewPolicy("192.168.127.0/24", "192.168.127.1", "5a:94:ef:e4:0c:dd", "192.168.127.254",
+		[]string{"*.example.com:443/tcp", "1.1.1.1:53/udp", "192.168.127.254:8080"},
+		[]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := netip.MustParseAddr("93.184.216.34")
+	spoofed := netip.MustParseAddr("203.0.113.9")
+	// only the answer from the gateway should be learned
+	answers := []struct {
+		mac [6]byte
+		src netip.Addr
+		dst netip.Addr
+	}{
+		{testGatewayMAC, testGateway, allowed},
+		{testGuestMAC, testGateway, spoofed},
+		{testGatewayMAC, netip.MustParseAddr("192.168.127.4"), spoofed},
+	}
+	for _, a := range answers {
+		payload := testAnswer(t, "www.example.com.", "cdn.example.com.", a.dst)
+		if !p.Filter(Inbound, testFrame(a.mac, a.src, testGuest, "udp", 53, 40000, payload)) {
+			t.Fatal("inbound frame was filtered")
+		}
+	}
+
+	tests := []struct {
+		name  string
+		dst   netip.Addr
+		proto string
+		port  int
+		want  bool
+	}{
+		{"learned name", allowed, "tcp", 443, true},
+		{"learned name on other port", allowed, "tcp", 80, false},
+		{"spoofed answer", spoofed, "tcp", 443, false},
+		{"allowed address", netip.MustParseAddr("1.1.1.1"), "udp", 53, true},
+		{"allowed address other protocol", netip.MustParseAddr("1.1.1.1"), "tcp", 53, false},
+		{"denied network", netip.MustParseAddr("10.1.2.3"), "udp", 53, false},
+		{"inside the subnet", netip.MustParseAddr("192.168.127.9"), "tcp", 22, true},
+		{"gateway", testGateway, "udp", 53, true},
+		{"host", netip.MustParseAddr("192.168.127.254"), "tcp", 8080, true},
+		{"host other port", netip.MustParseAddr("192.168.127.254"), "tcp", 22, false},
+		{"broadcast", netip.MustParseAddr("255.255.255.255"), "udp", 67, true},
+	}
+	for _, tt := range tests {
+		frame := testFrame(testGuestMAC, testGuest, tt.dst, tt.proto, 40000, tt.port, nil)
+		if got := p.Filter(Outbound, frame); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyLearnedLimit(t *testing.T) {
+	p, err := NewPolicy("192.168.127.0/24", "192.168.127.1", "5a:94:ef:e4:0c:dd", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := netip.MustParseAddr("198.18.0.0")
+	addr := first
+	for range maxLearned + 10 {
+		payload := testAnswer(t, "a.example.com.", "b.example.com.", addr)
+		p.Filter(Inbound, testFrame(testGatewayMAC, testGateway, testGuest, "udp", 53, 40000, payload))
+		addr = addr.Next()
+	}
+	if n := len(p.names); n != maxLearned {
+		t.Errorf("remembered %d addresses, want %d", n, maxLearned)
+	}
+	if names := p.lookup(first); names != nil {
+		t.Errorf("oldest address still has names %v", names)
+	}
+	if names := p.lookup(addr.Prev()); len(names) != 2 {
+		t.Errorf("newest address has names %v, want 2", names)
+	}
+}
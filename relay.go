@@ -0,0 +1,190 @@
+package env86
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// relay is a virtual network run outside the VM, such as by `env86 network`
+// or another VM, that the NIC joins over a websocket at NetworkRelayURL.
+// Next to the websocket endpoint a relay serves "tunnel" to dial TCP into
+// the network and "leases" for the addresses its DHCP server handed out.
+type relay struct {
+	url *url.URL
+}
+
+func newRelay(rawURL string) (*relay, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network relay URL: %w", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("network relay URL must be ws:// or wss://: %s", rawURL)
+	}
+	return &relay{url: u}, nil
+}
+
+// endpoint returns the URL of an endpoint next to the websocket endpoint,
+// keeping any query of the relay URL
+func (r *relay) endpoint(name string, query url.Values) *url.URL {
+	u := *r.url
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	q := u.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+// leases returns the DHCP leases of the network as a map of IP to MAC
+func (r *relay) leases(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.endpoint("leases", nil).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("network relay leases: %s", resp.Status)
+	}
+	var leases map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// lookup returns the IP leased to a MAC address
+func (r *relay) lookup(ctx context.Context, mac string) (string, error) {
+	leases, err := r.leases(ctx)
+	if err != nil {
+		return "", err
+	}
+	for ip, leased := range leases {
+		if strings.EqualFold(leased, mac) {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no address leased to %s on network relay", mac)
+}
+
+// dialTCP connects to addr inside the network through the tunnel
+// endpoint, which hijacks the request, writes OK, then proxies the
+// connection
+func (r *relay) dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	u := r.endpoint("tunnel", url.Values{"ip": {host}, "port": {port}})
+	hostport := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			hostport = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			hostport = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		d := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", hostport)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", hostport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	ok, err := br.Peek(2)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("network relay tunnel: %w", err)
+	}
+	if string(ok) != "OK" {
+		// not hijacked, so it's a regular error response
+		defer conn.Close()
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, fmt.Errorf("network relay tunnel: %w", err)
+		}
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("network relay tunnel: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	br.Discard(2)
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads through a bufio.Reader that may hold data read past
+// the tunnel handshake
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialGuest connects to a TCP port on the guest. On the built-in network
+// it dials the guest IP of the network config. On a relay it dials the
+// guest IP if set, otherwise the address leased to the VM NIC. Without
+// networking the guest service dials the port on the guest loopback.
+func (vm *VM) dialGuest(ctx context.Context, port int) (net.Conn, error) {
+	if vm.net != nil {
+		return vm.net.DialContextTCP(ctx, net.JoinHostPort(vm.config.Network.GuestIP, strconv.Itoa(port)))
+	}
+	if vm.relay == nil {
+		guest := vm.Guest()
+		if guest == nil {
+			return nil, errors.New("networking is not enabled and guest service is not connected")
+		}
+		if err := guest.ReadyContext(ctx); err != nil {
+			return nil, err
+		}
+		return guest.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	}
+	ip := vm.config.Network.GuestIP
+	if ip == "" {
+		mac, err := vm.MacAddressContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ip, err = vm.relay.lookup(ctx, mac)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vm.relay.dialTCP(ctx, net.JoinHostPort(ip, strconv.Itoa(port)))
+}
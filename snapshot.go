@@ -0,0 +1,236 @@
+package env86
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"tractor.dev/toolkit-go/engine/fs"
+)
+
+const snapshotsDir = "snapshots"
+
+// Snapshot is the metadata of a named state saved in an image
+// under snapshots/<name>. Parent is the snapshot the VM was booted
+// or restored from when it was taken, if any.
+type Snapshot struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Parent      string    `json:"parent,omitempty"`
+	Time        time.Time `json:"time"`
+	Size        int64     `json:"-"`
+}
+
+func validSnapshotName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	return nil
+}
+
+func snapshotPath(name string, elem ...string) string {
+	return path.Join(append([]string{snapshotsDir, name}, elem...)...)
+}
+
+// Snapshots returns all snapshots in the image sorted by time
+func (i *Image) Snapshots() ([]Snapshot, error) {
+	ok, err := fs.DirExists(i.FS, snapshotsDir)
+	if err != nil || !ok {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(i.FS, snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		snap, err := i.Snapshot(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(a, b int) bool {
+		return snapshots[a].Time.Before(snapshots[b].Time)
+	})
+	return snapshots, nil
+}
+
+// Snapshot returns the metadata of a named snapshot
+func (i *Image) Snapshot(name string) (Snapshot, error) {
+	if err := validSnapshotName(name); err != nil {
+		return Snapshot{}, err
+	}
+	b, err := fs.ReadFile(i.FS, snapshotPath(name, "snapshot.json"))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return Snapshot{}, err
+	}
+	snap.Name = name
+	fi, err := fs.Stat(i.FS, i.snapshotStateFile(name))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Size = fi.Size()
+	return snap, nil
+}
+
+func (i *Image) HasSnapshot(name string) bool {
+	if validSnapshotName(name) != nil {
+		return false
+	}
+	b, _ := fs.Exists(i.FS, i.snapshotStateFile(name))
+	return b
+}
+
+// snapshotStateFile returns the state filename of a snapshot, which
+// has a .zst extension if it's compressed
+func (i *Image) snapshotStateFile(name string) string {
+	if ok, _ := fs.Exists(i.FS, snapshotPath(name, "state.zst")); ok {
+		return snapshotPath(name, "state.zst")
+	}
+	return snapshotPath(name, "state")
+}
+
+// SnapshotStateConfig returns the initial state config to boot from a snapshot
+func (i *Image) SnapshotStateConfig(name string) *ImageConfig {
+	if !i.HasSnapshot(name) {
+		return nil
+	}
+	filename := i.snapshotStateFile(name)
+	fi, err := fs.Stat(i.FS, filename)
+	if err != nil {
+		return nil
+	}
+	return &ImageConfig{
+		URL:  "/image/" + filename,
+		Size: int(fi.Size()),
+	}
+}
+
+// OpenSnapshot returns a reader of the uncompressed state of a snapshot
+func (i *Image) OpenSnapshot(name string) (io.ReadCloser, error) {
+	if err := validSnapshotName(name); err != nil {
+		return nil, err
+	}
+	return openState(i.FS, snapshotPath(name, "state"))
+}
+
+// SaveSnapshot writes the state from r as the named snapshot in the given
+// format, replacing any existing snapshot of the same name. The time is set
+// if zero.
+func (i *Image) SaveSnapshot(snap Snapshot, r io.Reader, format StateFormat) error {
+	if err := validSnapshotName(snap.Name); err != nil {
+		return err
+	}
+	if snap.Time.IsZero() {
+		snap.Time = time.Now()
+	}
+	if err := fs.MkdirAll(i.FS, snapshotPath(snap.Name), 0755); err != nil {
+		return err
+	}
+	if err := writeState(i.FS, snapshotPath(snap.Name, "state"), r, format); err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fs.WriteFile(i.FS, snapshotPath(snap.Name, "snapshot.json"), meta, 0644); err != nil {
+		return err
+	}
+	return i.commit()
+}
+
+// DeleteSnapshot removes a named snapshot from the image
+func (i *Image) DeleteSnapshot(name string) error {
+	if !i.HasSnapshot(name) {
+		return fmt.Errorf("snapshot not found: %s", name)
+	}
+	rfs, ok := i.FS.(interface {
+		RemoveAll(path string) error
+	})
+	if !ok {
+		return fs.ErrPermission
+	}
+	if err := rfs.RemoveAll(snapshotPath(name)); err != nil {
+		return err
+	}
+	return i.commit()
+}
+
+// PromoteSnapshot makes a snapshot the initial state of the image
+func (i *Image) PromoteSnapshot(name string) error {
+	f, err := i.OpenSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return i.SaveInitialState(f)
+}
+
+// Snapshot saves the current state of the VM as a named snapshot in the image
+func (vm *VM) Snapshot(name string) error {
+	return vm.SnapshotContext(context.Background(), name, "")
+}
+
+func (vm *VM) SnapshotContext(ctx context.Context, name, description string) error {
+	if err := validSnapshotName(name); err != nil {
+		return err
+	}
+	r, err := vm.SaveContext(ctx)
+	if err != nil {
+		return err
+	}
+	snap := Snapshot{
+		Name:        name,
+		Description: description,
+		Parent:      vm.snapshot,
+	}
+	if name == vm.snapshot {
+		// saving over the snapshot we came from updates it in place
+		// rather than making it its own parent
+		snap.Parent = ""
+		if prev, err := vm.image.Snapshot(name); err == nil {
+			snap.Parent = prev.Parent
+			snap.Time = prev.Time
+			if description == "" {
+				snap.Description = prev.Description
+			}
+		}
+	}
+	if err := vm.image.SaveSnapshot(snap, r, vm.config.StateFormat); err != nil {
+		return err
+	}
+	vm.snapshot = name
+	return nil
+}
+
+// RestoreSnapshot loads a named snapshot from the image into the VM
+func (vm *VM) RestoreSnapshot(name string) error {
+	return vm.RestoreSnapshotContext(context.Background(), name)
+}
+
+func (vm *VM) RestoreSnapshotContext(ctx context.Context, name string) error {
+	f, err := vm.image.OpenSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := vm.RestoreContext(ctx, f); err != nil {
+		return err
+	}
+	vm.snapshot = name
+	return nil
+}
@@ -0,0 +1,195 @@
+package env86
+
+import (
+	"sync"
+	"time"
+)
+
+// State is a stage in the lifecycle of a VM
+type State int
+
+const (
+	StateCreated State = iota
+	StateStarting
+	StateRunning
+	StatePaused
+	StateSaving
+	StateStopped
+	StateCrashed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StatePaused:
+		return "paused"
+	case StateSaving:
+		return "saving"
+	case StateStopped:
+		return "stopped"
+	case StateCrashed:
+		return "crashed"
+	default:
+		return "unknown"
+	}
+}
+
+// ExitReason describes why a VM stopped
+type ExitReason string
+
+const (
+	ExitStopped      ExitReason = "Stopped"
+	ExitWindowClosed ExitReason = "Window closed"
+	ExitCtrlD        ExitReason = "Ctrl-D detected"
+	ExitPattern      ExitReason = "Exit pattern detected"
+	ExitCrashed      ExitReason = "Crashed"
+)
+
+// Event is published to subscribers on every state change. Reason and Err
+// are only set when entering StateStopped or StateCrashed.
+type Event struct {
+	State  State
+	Prev   State
+	Reason ExitReason
+	Err    error
+	Time   time.Time
+}
+
+// State returns the current lifecycle state of the VM
+func (vm *VM) State() State {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.state
+}
+
+// Events subscribes to state changes of the VM. Events are queued so a slow
+// consumer never misses one or blocks the VM. Calling the returned function
+// unsubscribes and closes the channel.
+func (vm *VM) Events() (<-chan Event, func()) {
+	s := newSubscriber()
+	vm.mu.Lock()
+	vm.subs[s] = struct{}{}
+	vm.mu.Unlock()
+	return s.ch, func() {
+		vm.mu.Lock()
+		delete(vm.subs, s)
+		vm.mu.Unlock()
+		s.close()
+	}
+}
+
+// Wait blocks until the VM stops and returns why. The error is non-nil if
+// the VM crashed or failed while exiting. Any number of goroutines can Wait.
+func (vm *VM) Wait() (ExitReason, error) {
+	vm.mu.Lock()
+	done := vm.done
+	vm.mu.Unlock()
+	<-done
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.exitReason, vm.exitErr
+}
+
+func (vm *VM) setState(state State) {
+	vm.transition(state, "", nil)
+}
+
+func (vm *VM) transition(state State, reason ExitReason, err error) bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	prev := vm.state
+	if prev == state || (prev.exited() && state != StateStarting) {
+		// only starting again leaves a stopped or crashed state
+		return false
+	}
+	vm.state = state
+	if prev.exited() {
+		vm.done = make(chan struct{})
+		vm.exitReason = ""
+		vm.exitErr = nil
+	}
+	if state.exited() {
+		vm.exitReason = reason
+		vm.exitErr = err
+		close(vm.done)
+	}
+	e := Event{
+		State:  state,
+		Prev:   prev,
+		Reason: reason,
+		Err:    err,
+		Time:   time.Now(),
+	}
+	for s := range vm.subs {
+		s.publish(e)
+	}
+	return true
+}
+
+func (s State) exited() bool {
+	return s == StateStopped || s == StateCrashed
+}
+
+type subscriber struct {
+	ch     chan Event
+	mu     sync.Mutex
+	queue  []Event
+	notify chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newSubscriber() *subscriber {
+	s := &subscriber{
+		ch:     make(chan Event),
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go s.pump()
+	return s
+}
+
+func (s *subscriber) publish(e Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) pump() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		select {
+		case s.ch <- e:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *subscriber) close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+}
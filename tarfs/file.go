@@ -15,6 +15,7 @@ type File struct {
 	data   *bytes.Reader
 	closed bool
 	fs     *FS
+	w      *writer
 }
 
 func (f *File) Close() error {
@@ -22,6 +23,11 @@ func (f *File) Close() error {
 		return os.ErrClosed
 	}
 
+	if f.w != nil {
+		f.fs.commit(f)
+		f.w = nil
+	}
+
 	f.closed = true
 	f.h = nil
 	f.data = nil
@@ -66,7 +72,17 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 	return f.data.Seek(offset, whence)
 }
 
-func (f *File) Write(p []byte) (n int, err error) { return 0, syscall.EROFS }
+func (f *File) Write(p []byte) (n int, err error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.w == nil {
+		return 0, syscall.EBADF
+	}
+
+	return f.w.buf.Write(p)
+}
 
 func (f *File) WriteAt(p []byte, off int64) (n int, err error) { return 0, syscall.EROFS }
 
@@ -98,6 +114,9 @@ func (f *File) ReadDir(count int) ([]fs.DirEntry, error) {
 		return nil, syscall.ENOTDIR
 	}
 
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
 	names, err := f.getDirectoryNames()
 	if err != nil {
 		return nil, err
@@ -140,7 +159,7 @@ func (f *File) Sync() error { return nil }
 
 func (f *File) Truncate(size int64) error { return syscall.EROFS }
 
-func (f *File) WriteString(s string) (ret int, err error) { return 0, syscall.EROFS }
+func (f *File) WriteString(s string) (ret int, err error) { return f.Write([]byte(s)) }
 
 type dirEntry struct {
 	fs.FileInfo
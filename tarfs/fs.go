@@ -1,4 +1,5 @@
-// package tarfs implements a read-only in-memory representation of a tar archive
+// package tarfs implements an in-memory representation of a tar archive.
+// Changes are kept in memory and never written to the underlying archive.
 package tarfs
 
 import (
@@ -8,13 +9,14 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
-	"time"
 )
 
 var Separator = string(filepath.Separator)
 
 type FS struct {
+	mu    sync.RWMutex
 	files map[string]map[string]*File
 }
 
@@ -41,6 +43,7 @@ func New(t *tar.Reader) *FS {
 		}
 
 		d, f := splitpath(hdr.Name)
+		fs.mkdirAll(d, 0755)
 		if _, ok := fs.files[d]; !ok {
 			fs.files[d] = make(map[string]*File)
 		}
@@ -82,6 +85,8 @@ func New(t *tar.Reader) *FS {
 }
 
 func (fs *FS) Open(name string) (fs.File, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	d, f := splitpath(name)
 	if _, ok := fs.files[d]; !ok {
 		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
@@ -101,27 +106,9 @@ func (fs *FS) Open(name string) (fs.File, error) {
 
 func (fs *FS) Name() string { return "tarfs" }
 
-func (fs *FS) Create(name string) (fs.File, error) { return nil, syscall.EROFS }
-
-func (fs *FS) Mkdir(name string, perm os.FileMode) error { return syscall.EROFS }
-
-func (fs *FS) MkdirAll(path string, perm os.FileMode) error { return syscall.EROFS }
-
-func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
-	if flag != os.O_RDONLY {
-		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
-	}
-
-	return fs.Open(name)
-}
-
-func (fs *FS) Remove(name string) error { return syscall.EROFS }
-
-func (fs *FS) RemoveAll(path string) error { return syscall.EROFS }
-
-func (fs *FS) Rename(oldname string, newname string) error { return syscall.EROFS }
-
 func (fs *FS) Stat(name string) (fs.FileInfo, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
 	d, f := splitpath(name)
 	if _, ok := fs.files[d]; !ok {
 		return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ENOENT}
@@ -134,9 +121,3 @@ func (fs *FS) Stat(name string) (fs.FileInfo, error) {
 
 	return file.h.FileInfo(), nil
 }
-
-func (fs *FS) Chmod(name string, mode fs.FileMode) error { return syscall.EROFS }
-
-func (fs *FS) Chown(name string, uid, gid int) error { return syscall.EROFS }
-
-func (fs *FS) Chtimes(name string, atime time.Time, mtime time.Time) error { return syscall.EROFS }
@@ -0,0 +1,273 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// mkdirAll adds directory entries for dir and any missing parents.
+// The caller must hold the write lock.
+func (fs *FS) mkdirAll(dir string, perm os.FileMode) {
+	if dir == Separator {
+		return
+	}
+	d, f := splitpath(dir)
+	if _, ok := fs.files[d][f]; !ok {
+		fs.mkdirAll(d, perm)
+		fs.put(d, f, &tar.Header{
+			Name:     headerName(dir),
+			Typeflag: tar.TypeDir,
+			Mode:     int64(perm.Perm()),
+			ModTime:  time.Now(),
+		}, nil)
+	}
+	if _, ok := fs.files[dir]; !ok {
+		fs.files[dir] = make(map[string]*File)
+	}
+}
+
+// put stores an entry, replacing any existing one. The caller must
+// hold the write lock.
+func (fs *FS) put(dir, name string, hdr *tar.Header, data []byte) {
+	if _, ok := fs.files[dir]; !ok {
+		fs.files[dir] = make(map[string]*File)
+	}
+	hdr.Size = int64(len(data))
+	fs.files[dir][name] = &File{
+		h:    hdr,
+		data: bytes.NewReader(data),
+		fs:   fs,
+	}
+}
+
+func headerName(name string) string {
+	return strings.TrimPrefix(filepath.ToSlash(name), "/")
+}
+
+func (fs *FS) lookup(name string) (*File, bool) {
+	d, f := splitpath(name)
+	file, ok := fs.files[d][f]
+	return file, ok
+}
+
+func (fs *FS) Create(name string) (fs.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *FS) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, f := splitpath(name)
+	if _, ok := fs.files[d]; !ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOENT}
+	}
+	if _, ok := fs.files[d][f]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EEXIST}
+	}
+	fs.mkdirAll(filepath.Join(d, f), perm)
+	return nil
+}
+
+func (fs *FS) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, f := splitpath(path)
+	if file, ok := fs.files[d][f]; ok && file.h.Typeflag != tar.TypeDir {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	fs.mkdirAll(filepath.Join(d, f), perm)
+	return nil
+}
+
+// OpenFile opens a file for reading like Open unless a write flag is
+// given. Written data is buffered and stored in the FS on Close.
+func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return fs.Open(name)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, f := splitpath(name)
+	if _, ok := fs.files[d]; !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	}
+
+	var hdr tar.Header
+	var data []byte
+	existing, ok := fs.files[d][f]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOENT}
+	case !ok:
+		hdr = tar.Header{
+			Name:     headerName(filepath.Join(d, f)),
+			Typeflag: tar.TypeReg,
+			Mode:     int64(perm.Perm()),
+		}
+	case existing.h.Typeflag == tar.TypeDir:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EEXIST}
+	default:
+		hdr = *existing.h
+		if flag&os.O_TRUNC == 0 {
+			data = make([]byte, existing.data.Size())
+			existing.data.ReadAt(data, 0)
+		}
+	}
+
+	if !ok {
+		// add the entry now so it can be changed before it's written
+		fs.put(d, f, &hdr, nil)
+	}
+
+	w := &writer{dir: d, name: f, base: data}
+	if flag&os.O_APPEND != 0 {
+		w.buf.Write(data)
+		w.base = nil
+	}
+	return &File{
+		h:    &hdr,
+		data: bytes.NewReader(data),
+		fs:   fs,
+		w:    w,
+	}, nil
+}
+
+// writer buffers writes to a file until it's closed. Writes start at the
+// beginning of the file, so any of base past the written length is kept.
+type writer struct {
+	dir  string
+	name string
+	base []byte
+	buf  bytes.Buffer
+}
+
+// commit stores the data written to f. The header is taken from the
+// current entry to keep changes made while f was open, and nothing is
+// stored if the entry has been removed since.
+func (fs *FS) commit(f *File) {
+	data := f.w.buf.Bytes()
+	if len(f.w.base) > len(data) {
+		data = append(data, f.w.base[len(data):]...)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	existing, ok := fs.files[f.w.dir][f.w.name]
+	if !ok {
+		return
+	}
+	hdr := *existing.h
+	hdr.ModTime = time.Now()
+	fs.put(f.w.dir, f.w.name, &hdr, data)
+}
+
+func (fs *FS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, f := splitpath(name)
+	file, ok := fs.files[d][f]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOENT}
+	}
+	if file.h.Typeflag == tar.TypeDir && len(fs.files[filepath.Join(d, f)]) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(fs.files[d], f)
+	delete(fs.files, filepath.Join(d, f))
+	return nil
+}
+
+func (fs *FS) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, f := splitpath(path)
+	if f == "" {
+		return &os.PathError{Op: "removeall", Path: path, Err: syscall.EINVAL}
+	}
+	delete(fs.files[d], f)
+	full := filepath.Join(d, f)
+	for dir := range fs.files {
+		if dir == full || strings.HasPrefix(dir, full+Separator) {
+			delete(fs.files, dir)
+		}
+	}
+	return nil
+}
+
+func (fs *FS) Rename(oldname string, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	od, of := splitpath(oldname)
+	nd, nf := splitpath(newname)
+	file, ok := fs.files[od][of]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldname, Err: syscall.ENOENT}
+	}
+	if _, ok := fs.files[nd]; !ok {
+		return &os.PathError{Op: "rename", Path: newname, Err: syscall.ENOENT}
+	}
+	oldpath, newpath := filepath.Join(od, of), filepath.Join(nd, nf)
+	delete(fs.files[od], of)
+	fs.files[nd][nf] = renamed(file, newpath)
+	for dir, entries := range fs.files {
+		if dir != oldpath && !strings.HasPrefix(dir, oldpath+Separator) {
+			continue
+		}
+		moved := newpath + strings.TrimPrefix(dir, oldpath)
+		delete(fs.files, dir)
+		fs.files[moved] = make(map[string]*File, len(entries))
+		for name, file := range entries {
+			fs.files[moved][name] = renamed(file, filepath.Join(moved, name))
+		}
+	}
+	return nil
+}
+
+func renamed(f *File, path string) *File {
+	hdr := *f.h
+	hdr.Name = headerName(path)
+	return &File{h: &hdr, data: f.data, fs: f.fs}
+}
+
+// update replaces the header of an entry with a modified copy so
+// files already open keep their original header.
+func (fs *FS) update(op, name string, fn func(hdr *tar.Header)) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	file, ok := fs.lookup(name)
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOENT}
+	}
+	hdr := *file.h
+	fn(&hdr)
+	file.h = &hdr
+	return nil
+}
+
+func (fs *FS) Chmod(name string, mode fs.FileMode) error {
+	return fs.update("chmod", name, func(hdr *tar.Header) {
+		hdr.Mode = int64(mode.Perm())
+	})
+}
+
+func (fs *FS) Chown(name string, uid, gid int) error {
+	return fs.update("chown", name, func(hdr *tar.Header) {
+		hdr.Uid = uid
+		hdr.Gid = gid
+	})
+}
+
+func (fs *FS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return fs.update("chtimes", name, func(hdr *tar.Header) {
+		hdr.AccessTime = atime
+		hdr.ModTime = mtime
+	})
+}
@@ -0,0 +1,240 @@
+package tarfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// testFS returns an FS of a tar archive with the given files, where names
+// ending in a slash are directories
+func testFS(t *testing.T, files ...string) *FS {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range files {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		var data []byte
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		} else {
+			data = []byte("data of " + name)
+			hdr.Size = int64(len(data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return New(tar.NewReader(&buf))
+}
+
+// archive writes fsys to a tar archive the way images are written back,
+// and reads it back as a new FS
+func archive(t *testing.T, fsys *FS) *FS {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: int64(fi.Mode().Perm()), Size: fi.Size()}
+		if d.IsDir() {
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return New(tar.NewReader(&buf))
+}
+
+func writeFile(t *testing.T, fsys *FS, name string, flag int, data string) {
+	t.Helper()
+	f, err := fsys.OpenFile(name, flag, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.(io.Writer).Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, fsys *FS, name, want string) {
+	t.Helper()
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if string(b) != want {
+		t.Errorf("%s has %q, want %q", name, b, want)
+	}
+}
+
+func checkGone(t *testing.T, fsys *FS, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := fsys.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: got %v, want not exist", name, err)
+		}
+	}
+}
+
+func TestWriteReload(t *testing.T) {
+	fsys := testFS(t, "etc/", "etc/hosts", "etc/motd")
+
+	if err := fsys.MkdirAll("srv/app/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fsys, "srv/app/data/new", os.O_WRONLY|os.O_CREATE, "new file")
+	writeFile(t, fsys, "etc/hosts", os.O_WRONLY|os.O_APPEND, " appended")
+	writeFile(t, fsys, "etc/motd", os.O_WRONLY, "DATA")
+	writeFile(t, fsys, "etc/motd2", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, "replaced")
+	writeFile(t, fsys, "etc/motd2", os.O_WRONLY|os.O_TRUNC, "short")
+	if err := fsys.Chmod("srv/app/data/new", 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := archive(t, fsys)
+	checkFile(t, reloaded, "srv/app/data/new", "new file")
+	checkFile(t, reloaded, "etc/hosts", "data of etc/hosts appended")
+	// writes without truncating replace the start of the file
+	checkFile(t, reloaded, "etc/motd", "DATA of etc/motd")
+	checkFile(t, reloaded, "etc/motd2", "short")
+	fi, err := reloaded.Stat("srv/app/data/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("mode is %v, want 0640", fi.Mode().Perm())
+	}
+	for _, dir := range []string{"srv", "srv/app", "srv/app/data"} {
+		if fi, err := reloaded.Stat(dir); err != nil || !fi.IsDir() {
+			t.Errorf("%s: %v, want a directory", dir, err)
+		}
+	}
+}
+
+func TestOpenFileErrors(t *testing.T) {
+	fsys := testFS(t, "etc/", "etc/hosts")
+	tests := []struct {
+		name string
+		flag int
+		err  error
+	}{
+		{"etc/missing", os.O_WRONLY, syscall.ENOENT},
+		{"missing/file", os.O_WRONLY | os.O_CREATE, syscall.ENOENT},
+		{"etc/hosts", os.O_WRONLY | os.O_CREATE | os.O_EXCL, syscall.EEXIST},
+		{"etc", os.O_WRONLY, syscall.EISDIR},
+	}
+	for _, tt := range tests {
+		if _, err := fsys.OpenFile(tt.name, tt.flag, 0644); !errors.Is(err, tt.err) {
+			t.Errorf("OpenFile(%q, %#x) = %v, want %v", tt.name, tt.flag, err, tt.err)
+		}
+	}
+}
+
+func TestRenameNested(t *testing.T) {
+	fsys := testFS(t, "a/", "a/b/", "a/b/c/", "a/b/c/file", "a/top", "ab/", "ab/file")
+
+	if err := fsys.Rename("a", "z"); err != nil {
+		t.Fatal(err)
+	}
+	checkGone(t, fsys, "a", "a/b", "a/b/c/file", "a/top")
+	checkFile(t, fsys, "z/b/c/file", "data of a/b/c/file")
+	checkFile(t, fsys, "z/top", "data of a/top")
+	// a directory that only shares a prefix isn't moved
+	checkFile(t, fsys, "ab/file", "data of ab/file")
+	names, err := fs.ReadDir(fsys, "z/b")
+	if err != nil || len(names) != 1 || names[0].Name() != "c" {
+		t.Errorf("z/b has %v, %v", names, err)
+	}
+
+	if err := fsys.Rename("z/b/c/file", "z/moved"); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, fsys, "z/moved", "data of a/b/c/file")
+	if err := fsys.Rename("z/moved", "missing/moved"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("rename into a missing directory: %v", err)
+	}
+
+	reloaded := archive(t, fsys)
+	checkFile(t, reloaded, "z/moved", "data of a/b/c/file")
+	checkFile(t, reloaded, "z/top", "data of a/top")
+	checkGone(t, reloaded, "a", "z/b/c/file")
+}
+
+func TestRemoveNested(t *testing.T) {
+	fsys := testFS(t, "a/", "a/b/", "a/b/c/", "a/b/c/file", "a/top", "ab/", "ab/file")
+
+	if err := fsys.Remove("a/b"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("remove of a directory with files: %v", err)
+	}
+	if err := fsys.Remove("a/top"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	checkGone(t, fsys, "a/top", "a/b", "a/b/c", "a/b/c/file")
+	if err := fsys.Remove("a"); err != nil {
+		t.Errorf("remove of an emptied directory: %v", err)
+	}
+	checkFile(t, fsys, "ab/file", "data of ab/file")
+	if err := fsys.RemoveAll("missing"); err != nil {
+		t.Errorf("RemoveAll of a missing path: %v", err)
+	}
+
+	// a file created in a removed directory isn't brought back by closing it
+	if err := fsys.MkdirAll("d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fsys.OpenFile("d/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll("d"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	reloaded := archive(t, fsys)
+	checkGone(t, reloaded, "a", "a/b/c/file", "d", "d/file")
+	checkFile(t, reloaded, "ab/file", "data of ab/file")
+}
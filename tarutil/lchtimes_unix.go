@@ -0,0 +1,28 @@
+//go:build !windows
+
+package tarutil
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lchtimes is os.Chtimes for a symbolic link itself instead of what it
+// points to. Since not every system can leave one of the times as it is,
+// a zero time is set to the other one.
+func lchtimes(path string, atime, mtime time.Time) error {
+	switch {
+	case atime.IsZero() && mtime.IsZero():
+		return nil
+	case atime.IsZero():
+		atime = mtime
+	case mtime.IsZero():
+		mtime = atime
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
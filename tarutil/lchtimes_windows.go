@@ -0,0 +1,9 @@
+package tarutil
+
+import "time"
+
+// lchtimes does nothing, since os.Chtimes on Windows would set the times
+// of what a symbolic link points to instead
+func lchtimes(path string, atime, mtime time.Time) error {
+	return nil
+}
@@ -0,0 +1,218 @@
+// Package tarutil writes and extracts the tar archives that env86 cp and
+// the guest service use to copy files between the host and a VM.
+package tarutil
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Write writes a tar archive of root to w with entries named from the base
+// name of root. Symbolic links are archived as links, and special files
+// like devices and sockets are left out. The data of regular files is also
+// written to progress if it's not nil.
+func Write(w io.Writer, root string, progress io.Writer) error {
+	top := filepath.Base(root)
+	if top == string(filepath.Separator) {
+		return errors.New("can't archive the root directory")
+	}
+	if progress == nil {
+		progress = io.Discard
+	}
+	bw := bufio.NewWriterSize(w, 32*1024)
+	tw := tar.NewWriter(bw)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		switch mode := fi.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case !mode.IsRegular() && !mode.IsDir():
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(top, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// PAX keeps mtimes to the nanosecond
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, io.TeeReader(f, progress), hdr.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Extract extracts a tar archive into dir, with the top level name of
+// entries replaced by name if not empty, so an archive of foo can be
+// extracted as bar. Permissions, symbolic links and mtimes are kept.
+// Entries can't be written outside dir, even through symbolic links in the
+// archive. The data of regular files is also written to progress if it's
+// not nil.
+func Extract(r io.Reader, dir, name string, progress io.Writer) error {
+	if progress == nil {
+		progress = io.Discard
+	}
+	tr := tar.NewReader(r)
+	// directories get their mode and mtime last, since adding to them
+	// changes their mtime and a read-only mode would stop their contents
+	// being added
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := entryPath(hdr.Name, name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if err := checkParents(dir, rel); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+				return fmt.Errorf("%s: not a directory", target)
+			}
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			hdr.Name = target
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, io.TeeReader(tr, progress))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			if err := os.Chmod(target, hdr.FileInfo().Mode()); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			if err := lchtimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].Name, dirs[i].FileInfo().Mode()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].Name, dirs[i].AccessTime, dirs[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryPath returns the relative path to extract an entry to, with its
+// top level name replaced by name if not empty
+func entryPath(entry, name string) (string, error) {
+	p := path.Clean(entry)
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("archive entry %q is outside the destination", entry)
+	}
+	if name != "" {
+		_, rest, _ := strings.Cut(p, "/")
+		p = path.Join(name, rest)
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// checkParents makes sure an archive can't write outside dir through a
+// symbolic link it extracted earlier
+func checkParents(dir, rel string) error {
+	parent := dir
+	for _, part := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		parent = filepath.Join(parent, part)
+		fi, err := os.Lstat(parent)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("archive entry %s is below a symbolic link", rel)
+		}
+	}
+	return nil
+}
+
+// removeNonDir removes what's at path unless it's a directory, so a file
+// or link can replace it without writing through a link
+func removeNonDir(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s: is a directory", path)
+	}
+	return os.Remove(path)
+}
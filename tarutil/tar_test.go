@@ -0,0 +1,134 @@
+package tarutil
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEntryPath(t *testing.T) {
+	tests := []struct {
+		entry string
+		name  string
+		want  string
+		err   bool
+	}{
+		{entry: "foo", want: "foo"},
+		{entry: "foo/", want: "foo"},
+		{entry: "foo/bar/baz", want: "foo/bar/baz"},
+		{entry: "foo/../foo/bar", want: "foo/bar"},
+		{entry: "./foo/bar", want: "foo/bar"},
+		{entry: "foo", name: "bar", want: "bar"},
+		{entry: "foo/", name: "bar", want: "bar"},
+		{entry: "foo/a/b", name: "bar", want: "bar/a/b"},
+		{entry: "foo/..", want: "."},
+		{entry: "/etc/passwd", err: true},
+		{entry: "..", err: true},
+		{entry: "../foo", err: true},
+		{entry: "foo/../../bar", err: true},
+		{entry: "../foo", name: "bar", err: true},
+	}
+	for _, tt := range tests {
+		got, err := entryPath(tt.entry, tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("entryPath(%q, %q) = %q, want error", tt.entry, tt.name, got)
+			}
+			continue
+		}
+		if want := filepath.FromSlash(tt.want); err != nil || got != want {
+			t.Errorf("entryPath(%q, %q) = %q, %v, want %q", tt.entry, tt.name, got, err, want)
+		}
+	}
+}
+
+func TestCheckParents(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a", "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, "a", "link")); err != nil {
+		t.Skip("can't make symbolic links:", err)
+	}
+
+	tests := []struct {
+		rel string
+		err bool
+	}{
+		{rel: "a"},
+		{rel: "a/b"},
+		{rel: "a/b/c"},
+		{rel: "a/link"},
+		{rel: "a/new/c"},
+		{rel: "new/link/c"},
+		{rel: "a/link/c", err: true},
+		{rel: "a/link/b/c", err: true},
+	}
+	for _, tt := range tests {
+		err := checkParents(dir, filepath.FromSlash(tt.rel))
+		if tt.err != (err != nil) {
+			t.Errorf("checkParents(%q) = %v, want error %v", tt.rel, err, tt.err)
+		}
+	}
+}
+
+func TestWriteExtract(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "dir", "file"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(src, "link")); err != nil {
+		t.Skip("can't make symbolic links:", err)
+	}
+	if err := lchtimes(filepath.Join(src, "link"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"dir/file", "dir", "."} {
+		if err := os.Chtimes(filepath.Join(src, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf, written, extracted bytes.Buffer
+	if err := Write(&buf, src, &written); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := Extract(&buf, dst, "dst", &extracted); err != nil {
+		t.Fatal(err)
+	}
+	if written.String() != "hello" || extracted.String() != "hello" {
+		t.Errorf("progress got %q written and %q extracted", written.String(), extracted.String())
+	}
+
+	b, err := os.ReadFile(filepath.Join(dst, "dst", "dir", "file"))
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("file has %q, %v", b, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "dst", "link")); err != nil || link != "dir/file" {
+		t.Errorf("link points to %q, %v", link, err)
+	}
+	paths := []string{"dst/dir/file", "dst/dir", "dst"}
+	if runtime.GOOS != "windows" {
+		paths = append(paths, "dst/link")
+	}
+	for _, p := range paths {
+		fi, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", p, fi.ModTime(), mtime)
+		}
+	}
+}
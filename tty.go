@@ -38,7 +38,7 @@ func (vm *VM) handleTTY(ch io.ReadWriteCloser) {
 						<-time.After(200 * time.Millisecond) // give moment for stdout to flush
 						term.Restore(int(os.Stdin.Fd()), oldstate)
 						ch.Close()
-						vm.Exit("Exit pattern detected")
+						vm.Exit(ExitPattern)
 						return
 					}
 					// Keep only the last len(pattern)-1 bytes in temp to handle patterns spanning chunks
@@ -76,7 +76,7 @@ func (vm *VM) handleTTY(ch io.ReadWriteCloser) {
 			if buffer[i] == 4 {
 				term.Restore(int(os.Stdin.Fd()), oldstate)
 				ch.Close()
-				vm.Exit("Ctrl-D detected")
+				vm.Exit(ExitCtrlD)
 				return
 			}
 		}
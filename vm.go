@@ -3,25 +3,29 @@ package env86
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/progrium/env86/assets"
 	"github.com/progrium/env86/namespacefs"
+	"github.com/progrium/env86/network"
 
-	"github.com/chromedp/chromedp"
 	"github.com/progrium/go-netstack/vnet"
-	"tractor.dev/toolkit-go/desktop"
-	"tractor.dev/toolkit-go/desktop/app"
-	"tractor.dev/toolkit-go/desktop/window"
 	"tractor.dev/toolkit-go/duplex/fn"
 	"tractor.dev/toolkit-go/duplex/talk"
 	"tractor.dev/toolkit-go/engine/fs"
 )
 
+// ErrNotReady is returned by calls that need the emulator or guest service
+// to be connected before it is.
+var ErrNotReady = errors.New("not ready")
+
 type VM struct {
 	image      *Image
 	config     Config
@@ -30,14 +34,28 @@ type VM struct {
 	addr       string
 	fsys       fs.FS
 	net        *vnet.VirtualNetwork
+	relay      *relay
+	capture    *network.Capture
+	policy     *network.Policy
+	records    *network.Records
 	srv        *http.Server
-	win        *window.Window
-	app        *app.App
-	peer       *talk.Peer
+	backend    Backend
+	peer       atomic.Pointer[talk.Peer]
 	serialPipe net.Conn
+	netPipe    net.Conn
 	loaded     chan bool
-	stopped    chan bool
-	cdpCancel  func()
+	snapshot   string
+	forwards   map[string]*forwarder
+
+	mu         sync.Mutex
+	host       Host
+	state      State
+	done       chan struct{}
+	exitReason ExitReason
+	exitErr    error
+	subs       map[*subscriber]struct{}
+	// forwardsClosed is set once the VM stops until it starts again
+	forwardsClosed bool
 }
 
 func New(image *Image, config Config) (*VM, error) {
@@ -60,14 +78,35 @@ func New(image *Image, config Config) (*VM, error) {
 		config.Filesystem.BaseURL = "/image/fs/"
 	}
 	if config.MemorySize == 0 {
-		config.MemorySize = 512 * 1024 * 1024 // 512MB
+		config.MemorySize = DefaultMemorySize
 	}
 	if config.VGAMemorySize == 0 {
-		config.VGAMemorySize = 8 * 1024 * 1024 // 8MB
+		config.VGAMemorySize = DefaultVGAMemorySize
+	}
+	var stateFile string
+	if config.Snapshot != "" && config.InitialState == nil {
+		if !image.HasSnapshot(config.Snapshot) {
+			return nil, fmt.Errorf("snapshot not found: %s", config.Snapshot)
+		}
+		config.InitialState = image.SnapshotStateConfig(config.Snapshot)
+		config.ColdBoot = false
+		stateFile = snapshotPath(config.Snapshot, "state")
 	}
 	// should this be done in Image.Config()?
 	if config.InitialState == nil && image.HasInitialState() && !config.ColdBoot {
 		config.InitialState = image.InitialStateConfig()
+		stateFile = "initial.state"
+	}
+	if stateFile != "" {
+		f, err := openState(image.FS, stateFile)
+		if err != nil {
+			return nil, err
+		}
+		err = checkStateMemory(f, config.MemorySize)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
 	}
 	if config.InitialState == nil && !image.HasInitialState() {
 		config.ColdBoot = true
@@ -93,59 +132,107 @@ func New(image *Image, config Config) (*VM, error) {
 	}
 
 	vm := &VM{
-		image:   image,
-		config:  config,
-		fsys:    fsys,
-		addr:    config.ConsoleAddr,
-		stopped: make(chan bool),
+		image:    image,
+		config:   config,
+		fsys:     fsys,
+		addr:     config.ConsoleAddr,
+		state:    StateCreated,
+		snapshot: config.Snapshot,
+		done:     make(chan struct{}),
+		subs:     make(map[*subscriber]struct{}),
 	}
 	vm.console = &Console{vm: vm}
 
-	if config.EnableNetwork {
+	vm.backend = config.Backend
+	if vm.backend == nil {
+		if config.ChromeDP {
+			vm.backend = &ChromeDPBackend{}
+		} else {
+			vm.backend = &WebviewBackend{}
+		}
+	}
+
+	if config.NetworkRelayURL != "" {
+		// join an existing network instead of creating one, so only
+		// the guest IP of the network config applies
+		var err error
+		vm.relay, err = newRelay(config.NetworkRelayURL)
+		if err != nil {
+			return nil, err
+		}
+		if len(config.Network.Allow) > 0 || len(config.Network.Deny) > 0 {
+			return nil, errors.New("firewall rules are not available when joining a network relay")
+		}
+		if len(config.Network.DNS) > 0 {
+			return nil, errors.New("DNS records are not available when joining a network relay")
+		}
+		vm.config.EnableNetwork = true
+	} else if config.EnableNetwork {
 		var err error
-		vm.net, err = vnet.New(&vnet.Configuration{
-			Debug:             false,
-			MTU:               1500,
-			Subnet:            "192.168.127.0/24",
-			GatewayIP:         "192.168.127.1",
-			GatewayMacAddress: "5a:94:ef:e4:0c:dd",
-			GatewayVirtualIPs: []string{"192.168.127.253"},
-		})
+		vm.config.Network, err = config.Network.Resolve()
+		if err != nil {
+			return nil, err
+		}
+		vm.net, err = NewNetwork(vm.config.Network)
+		if err != nil {
+			return nil, err
+		}
+		vm.policy, err = vm.config.Network.Policy()
+		if err != nil {
+			return nil, err
+		}
+		vm.records, err = vm.config.Network.Records()
 		if err != nil {
 			return nil, err
 		}
 		vm.config.NetworkRelayURL = fmt.Sprintf("ws://%s/net", LocalhostAddr(vm.addr))
 	}
 
+	if config.CaptureFile != "" || config.NetworkTap != nil {
+		if vm.relay != nil {
+			return nil, errors.New("packet capture is not available when joining a network relay")
+		}
+	}
+	if config.NetworkConditions != nil {
+		if vm.relay != nil {
+			return nil, errors.New("network conditions are not available when joining a network relay")
+		}
+		if err := config.NetworkConditions.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.CaptureFile != "" {
+		var err error
+		vm.capture, err = network.CreateCapture(config.CaptureFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return vm, nil
 }
 
-func (vm *VM) Exit(reason string) {
+func (vm *VM) Exit(reason ExitReason) {
 	// not sure if this should be on this API
 	// because its made for the CLI and writes to stdout
-	if vm.config.SaveOnExit {
+	var err error
+	if vm.config.SaveSnapshot != "" {
+		fmt.Printf("\r\n%s. Saving snapshot %s...\n", reason, vm.config.SaveSnapshot)
+		err = vm.SnapshotContext(context.Background(), vm.config.SaveSnapshot, vm.config.SnapshotDescription)
+	} else if vm.config.SaveOnExit {
 		fmt.Printf("\r\n%s. Saving...\n", reason)
-		err := vm.SaveInitialState()
-		if err != nil {
-			log.Fatal(err)
-		}
+		err = vm.SaveInitialState()
 	} else {
 		fmt.Printf("\r\n%s. Exiting...\n", reason)
 	}
-	vm.Stop()
+	vm.stop(reason, err)
 }
 
 func (vm *VM) Start() error {
-	if vm.app == nil && !vm.config.ChromeDP {
-		launched := make(chan bool)
-		vm.app = app.Run(app.Options{
-			Accessory: true,
-			Agent:     true,
-		}, func() {
-			launched <- true
-		})
-		<-launched
-	}
+	vm.setState(StateStarting)
+	vm.mu.Lock()
+	vm.forwardsClosed = false
+	vm.mu.Unlock()
 
 	if vm.srv == nil {
 		go vm.startHTTP()
@@ -153,31 +240,34 @@ func (vm *VM) Start() error {
 
 	vm.loaded = make(chan bool)
 	url := fmt.Sprintf("http://%s/console.html", LocalhostAddr(vm.addr))
-	if vm.config.ChromeDP {
-		ctx, cancel := chromedp.NewContext(context.Background())
-		vm.cdpCancel = cancel
-		go func() {
-			if err := chromedp.Run(ctx, chromedp.Navigate(url)); err != nil {
-				log.Println(err)
-			}
-		}()
-	} else {
-		desktop.Dispatch(func() {
-			vm.win = window.New(window.Options{
-				Center: true,
-				Hidden: vm.config.NoConsole,
-				Size: window.Size{
-					Width:  1004,
-					Height: 785,
-				},
-				Resizable: true,
-				URL:       url,
-			})
-			vm.win.Reload()
-		})
-	}
-	<-vm.loaded
+	host, err := vm.backend.Launch(url, vm.config, vm.crash)
+	if err != nil {
+		vm.crash(err)
+		return err
+	}
+	vm.mu.Lock()
+	stopped := vm.state.exited()
+	if !stopped {
+		vm.host = host
+	}
+	done := vm.done
+	vm.mu.Unlock()
+	if stopped {
+		// stopped while launching, after shutdown looked for a host to close
+		host.Close()
+	}
+	select {
+	case <-vm.loaded:
+	case <-done:
+		vm.loaded = nil
+		_, err := vm.Wait()
+		if err == nil {
+			err = fmt.Errorf("stopped while starting")
+		}
+		return err
+	}
 	vm.loaded = nil
+	vm.setState(StateRunning)
 	return nil
 }
 
@@ -190,6 +280,11 @@ func (vm *VM) Close() error {
 			return err
 		}
 	}
+	if vm.capture != nil {
+		if err := vm.capture.Close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -197,27 +292,39 @@ func (vm *VM) Run() error {
 	if err := vm.Start(); err != nil {
 		return err
 	}
-	return vm.Wait()
+	_, err := vm.Wait()
+	return err
 }
 
 func (vm *VM) Stop() error {
-	if vm.win != nil {
-		desktop.Dispatch(func() {
-			vm.win.Unload()
-			vm.win = nil
-		})
-	}
-	if vm.cdpCancel != nil {
-		vm.cdpCancel()
-		vm.cdpCancel = nil
-	}
-	select {
-	case vm.stopped <- true:
-	default:
-	}
+	vm.stop(ExitStopped, nil)
 	return nil
 }
 
+func (vm *VM) crash(err error) {
+	vm.shutdown()
+	vm.transition(StateCrashed, ExitCrashed, err)
+}
+
+func (vm *VM) stop(reason ExitReason, err error) {
+	vm.shutdown()
+	vm.transition(StateStopped, reason, err)
+}
+
+func (vm *VM) shutdown() {
+	vm.peer.Store(nil)
+	vm.closeForwards()
+	vm.mu.Lock()
+	host := vm.host
+	vm.host = nil
+	vm.mu.Unlock()
+	if host != nil {
+		if err := host.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func (vm *VM) Restart() error {
 	if err := vm.Stop(); err != nil {
 		return err
@@ -225,35 +332,53 @@ func (vm *VM) Restart() error {
 	return vm.Start()
 }
 
-func (vm *VM) Wait() error {
-	// todo: make work correctly for multiple Waits
-	<-vm.stopped
-	return nil
+func (vm *VM) Pause() error {
+	return vm.PauseContext(context.Background())
 }
 
-func (vm *VM) Pause() (err error) {
-	if vm.peer == nil {
-		return
+func (vm *VM) PauseContext(ctx context.Context) error {
+	peer := vm.peer.Load()
+	if peer == nil {
+		return ErrNotReady
+	}
+	if _, err := peer.Call(ctx, "pause", nil, nil); err != nil {
+		return err
 	}
-	_, err = vm.peer.Call(context.TODO(), "pause", nil, nil)
-	return
+	vm.setState(StatePaused)
+	return nil
+}
+
+func (vm *VM) Unpause() error {
+	return vm.UnpauseContext(context.Background())
 }
 
-func (vm *VM) Unpause() (err error) {
-	if vm.peer == nil {
-		return
+func (vm *VM) UnpauseContext(ctx context.Context) error {
+	peer := vm.peer.Load()
+	if peer == nil {
+		return ErrNotReady
+	}
+	if _, err := peer.Call(ctx, "unpause", nil, nil); err != nil {
+		return err
 	}
-	_, err = vm.peer.Call(context.TODO(), "unpause", nil, nil)
-	return
+	vm.setState(StateRunning)
+	return nil
 }
 
 // Save saves the state of the VM
 func (vm *VM) Save() (io.Reader, error) {
-	if vm.peer == nil {
-		return nil, fmt.Errorf("not ready")
+	return vm.SaveContext(context.Background())
+}
+
+func (vm *VM) SaveContext(ctx context.Context) (io.Reader, error) {
+	peer := vm.peer.Load()
+	if peer == nil {
+		return nil, ErrNotReady
 	}
+	prev := vm.State()
+	vm.setState(StateSaving)
 	var b []byte
-	_, err := vm.peer.Call(context.TODO(), "save", nil, &b)
+	_, err := peer.Call(ctx, "save", nil, &b)
+	vm.setState(prev)
 	if err != nil {
 		return nil, err
 	}
@@ -261,23 +386,35 @@ func (vm *VM) Save() (io.Reader, error) {
 }
 
 func (vm *VM) SaveInitialState() error {
-	r, err := vm.Save()
+	return vm.SaveInitialStateContext(context.Background())
+}
+
+func (vm *VM) SaveInitialStateContext(ctx context.Context) error {
+	r, err := vm.SaveContext(ctx)
 	if err != nil {
 		return err
 	}
-	return vm.image.SaveInitialState(r)
+	return vm.image.SaveInitialStateFormat(r, vm.config.StateFormat)
 }
 
 // Restore loads state into the VM
 func (vm *VM) Restore(state io.Reader) error {
-	if vm.peer == nil {
-		return fmt.Errorf("not ready")
+	return vm.RestoreContext(context.Background(), state)
+}
+
+func (vm *VM) RestoreContext(ctx context.Context, state io.Reader) error {
+	peer := vm.peer.Load()
+	if peer == nil {
+		return ErrNotReady
 	}
 	b, err := io.ReadAll(state)
 	if err != nil {
 		return err
 	}
-	_, err = vm.peer.Call(context.TODO(), "restore", fn.Args{b}, nil)
+	if err := checkStateMemory(bytes.NewReader(b), vm.config.MemorySize); err != nil {
+		return err
+	}
+	_, err = peer.Call(ctx, "restore", fn.Args{b}, nil)
 	return err
 }
 
@@ -298,23 +435,53 @@ func (vm *VM) SerialPipe() (io.ReadWriter, error) {
 	return a, nil
 }
 
-// NetworkPipe returns an io.ReadWriter of Ethernet packets to the virtual NIC
+// NetworkPipe returns an io.ReadWriter of Ethernet packets to the virtual NIC.
+// Each frame is prefixed with its length as a 32-bit big endian integer, the
+// same framing used by vnet.VirtualNetwork.AcceptQemu. It must be called before
+// Start, and once called the NIC is attached to the pipe instead of the built-in
+// virtual network, whether or not EnableNetwork is set.
 func (vm *VM) NetworkPipe() (io.ReadWriter, error) {
-	return nil, fmt.Errorf("TODO")
+	a, b := net.Pipe()
+	vm.netPipe = b
+	vm.config.NetworkRelayURL = fmt.Sprintf("ws://%s/net", LocalhostAddr(vm.addr))
+	return a, nil
 }
 
 func (vm *VM) MacAddress() (string, error) {
-	if vm.peer == nil {
-		return "", fmt.Errorf("not ready")
+	return vm.MacAddressContext(context.Background())
+}
+
+func (vm *VM) MacAddressContext(ctx context.Context) (string, error) {
+	peer := vm.peer.Load()
+	if peer == nil {
+		return "", ErrNotReady
 	}
 	var mac string
-	_, err := vm.peer.Call(context.TODO(), "mac", nil, &mac)
+	_, err := peer.Call(ctx, "mac", nil, &mac)
 	if err != nil {
 		return "", err
 	}
 	return mac, nil
 }
 
+// networkOptions returns the options for frames of the VM NIC
+func (vm *VM) networkOptions() network.Options {
+	opts := network.Options{
+		Policy:     vm.policy,
+		Records:    vm.records,
+		Conditions: vm.config.NetworkConditions,
+	}
+	if vm.capture != nil {
+		opts.Taps = append(opts.Taps, vm.capture.Tap)
+	}
+	if vm.config.NetworkTap != nil {
+		opts.Taps = append(opts.Taps, vm.config.NetworkTap)
+	}
+	return opts
+}
+
+// Network returns the virtual network created for the VM, which is nil
+// if networking isn't enabled or the VM joined a network relay
 func (vm *VM) Network() *vnet.VirtualNetwork {
 	return vm.net
 }